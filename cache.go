@@ -0,0 +1,82 @@
+package traefik_warp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+// cacheEntry is the on-disk form of one provider's fetched ranges.
+type cacheEntry struct {
+	Provider  string    `json:"provider"`
+	URLs      []string  `json:"urls"`
+	FetchedAt time.Time `json:"fetchedAt"`
+	CIDRs     []string  `json:"cidrs"`
+}
+
+func cachePath(dir string, p providers.Provider) string {
+	return filepath.Join(dir, "warp-"+string(p)+".json")
+}
+
+// readCache loads the cached ranges of p. Entries fetched from other URLs
+// (e.g. after a rangesUrl change) are treated as missing.
+func readCache(dir string, p providers.Provider, urls []string) (*cacheEntry, error) {
+	body, err := os.ReadFile(cachePath(dir, p))
+	if err != nil {
+		return nil, err
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, fmt.Errorf("decode cache %s: %w", cachePath(dir, p), err)
+	}
+	if e.Provider != string(p) || !sameStrings(e.URLs, urls) || len(e.CIDRs) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return &e, nil
+}
+
+// writeCache stores e atomically (temp file + rename), so concurrent readers
+// never see a partial file.
+func writeCache(dir string, e *cacheEntry) error {
+	body, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".warp-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cachePath(dir, providers.Provider(e.Provider)))
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
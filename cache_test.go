@@ -0,0 +1,131 @@
+package traefik_warp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingFeed counts hits and serves a CIDR list, or 503 when failing.
+type countingFeed struct {
+	flakyFeed
+	hits int32
+}
+
+func (f *countingFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&f.hits, 1)
+	f.flakyFeed.ServeHTTP(w, r)
+}
+
+func Test_Cache_WrittenAndReusedAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	feed := &countingFeed{flakyFeed: flakyFeed{body: "192.0.2.0/24\n"}}
+	srv := httptest.NewServer(feed)
+	defer srv.Close()
+
+	d := newFeedDisolver(t, srv.URL, fallbackKeep)
+	d.cacheDir, d.refreshInterval = dir, time.Hour
+	if err := loadRanges(t, d); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if _, err := os.Stat(cachePath(dir, "examplecdn")); err != nil {
+		t.Fatalf("cache not written: %v", err)
+	}
+
+	// "Restart" with the endpoint down: the fresh cache is used without fetching.
+	sharedRanges.release(d)
+	atomic.StoreInt32(&feed.failing, 1)
+	hits := atomic.LoadInt32(&feed.hits)
+	d2 := newFeedDisolver(t, srv.URL, fallbackKeep)
+	d2.cacheDir, d2.refreshInterval = dir, time.Hour
+	if err := loadRanges(t, d2); err != nil {
+		t.Fatalf("refresh from cache: %v", err)
+	}
+	if got := atomic.LoadInt32(&feed.hits); got != hits {
+		t.Fatalf("expected no fetch with fresh cache, got %d extra", got-hits)
+	}
+	if !d2.trust("192.0.2.1:443", nil).trusted {
+		t.Fatalf("cached range not trusted")
+	}
+}
+
+func Test_Cache_StaleEntryRefetchedAndKeptOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	feed := &countingFeed{flakyFeed: flakyFeed{failing: 1}}
+	srv := httptest.NewServer(feed)
+	defer srv.Close()
+
+	stale := &cacheEntry{Provider: "examplecdn", URLs: []string{srv.URL}, FetchedAt: time.Now().Add(-2 * time.Hour), CIDRs: []string{"198.51.100.0/24"}}
+	if err := writeCache(dir, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newFeedDisolver(t, srv.URL, fallbackKeep)
+	d.cacheDir, d.refreshInterval = dir, time.Hour
+	if err := loadRanges(t, d); err == nil {
+		t.Fatalf("expected fetch error")
+	}
+	if atomic.LoadInt32(&feed.hits) == 0 {
+		t.Fatalf("stale cache should trigger a fetch")
+	}
+	if !d.trust("198.51.100.1:443", nil).trusted {
+		t.Fatalf("stale cache should be kept as last-known-good")
+	}
+}
+
+func Test_Cache_FreshEntryEndsBackoff(t *testing.T) {
+	dir := t.TempDir()
+	feed := &countingFeed{flakyFeed: flakyFeed{failing: 1}}
+	srv := httptest.NewServer(feed)
+	defer srv.Close()
+
+	d := newFeedDisolver(t, srv.URL, fallbackKeep)
+	d.cacheDir, d.refreshInterval = dir, time.Hour
+	d.retryMin, d.retryMax = time.Second, time.Minute
+	if err := loadRanges(t, d); err == nil {
+		t.Fatalf("expected fetch error")
+	}
+	e := d.entries["examplecdn"]
+	if got := e.nextDelay(); got != time.Second {
+		t.Fatalf("expected backoff after failure, got %s", got)
+	}
+
+	// Another instance fetched the list in the meantime.
+	fresh := &cacheEntry{Provider: "examplecdn", URLs: []string{srv.URL}, FetchedAt: time.Now(), CIDRs: []string{"198.51.100.0/24"}}
+	if err := writeCache(dir, fresh); err != nil {
+		t.Fatal(err)
+	}
+	hits := atomic.LoadInt32(&feed.hits)
+	if err := refreshRanges(d); err != nil {
+		t.Fatalf("refresh from cache: %v", err)
+	}
+	if got := atomic.LoadInt32(&feed.hits); got != hits {
+		t.Fatalf("expected no fetch with fresh cache, got %d extra", got-hits)
+	}
+	e.refreshMu.Lock()
+	failures, lastErr := e.st.failures, e.st.lastErr
+	e.refreshMu.Unlock()
+	if failures != 0 || lastErr != nil {
+		t.Fatalf("expected failure state cleared, got failures=%d lastErr=%v", failures, lastErr)
+	}
+	if got := e.nextDelay(); got != time.Hour {
+		t.Fatalf("expected normal interval after fresh cache, got %s", got)
+	}
+	if !d.trust("198.51.100.1:443", nil).trusted {
+		t.Fatalf("cached range not trusted")
+	}
+}
+
+func Test_Cache_IgnoredWhenURLsChange(t *testing.T) {
+	dir := t.TempDir()
+	e := &cacheEntry{Provider: "examplecdn", URLs: []string{"https://old.example"}, FetchedAt: time.Now(), CIDRs: []string{"198.51.100.0/24"}}
+	if err := writeCache(dir, e); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readCache(dir, "examplecdn", []string{"https://new.example"}); !os.IsNotExist(err) {
+		t.Fatalf("expected cache miss, got %v", err)
+	}
+}
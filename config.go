@@ -4,20 +4,111 @@ import "github.com/l4rm4nd/traefik-warp/providers"
 
 // Config the plugin configuration.
 type Config struct {
-	Provider            string              `json:"provider,omitempty"`
-	TrustIP             map[string][]string `json:"trustip"`
-        AutoRefresh         bool                `json:"autoRefresh,omitempty"`     // enable periodic refresh
-	RefreshInterval     string              `json:"refreshInterval,omitempty"` // e.g. "12h", "1h"
-        Debug               bool                `json:"debug,omitempty"`
+	Provider            string                  `json:"provider,omitempty"`
+	TrustIP             map[string][]string     `json:"trustip"`
+	TrustIPFile         map[string][]string     `json:"trustipFile,omitempty"`          // per-provider files with one CIDR per line
+	ExcludeIP           map[string][]string     `json:"excludeIp,omitempty"`            // per-provider CIDRs carved out of the trusted ranges
+	IntermediateProxies []string                `json:"intermediateProxies,omitempty"`  // CIDRs of load balancers between the edge and Traefik
+	CloudflareTunnel    CloudflareTunnel        `json:"cloudflareTunnel,omitempty"`     // trust local cloudflared connectors
+	TrustSource         TrustSource             `json:"trustSource,omitempty"`          // address the trust decision is based on
+	OriginPull          OriginPull              `json:"cloudflareOriginPull,omitempty"` // require Cloudflare Authenticated Origin Pulls
+	AllowAnyTrust       bool                    `json:"allowAnyTrust,omitempty"`        // permit 0.0.0.0/0 and ::/0 in trust settings
+	RangesURL           map[string][]string     `json:"rangesUrl,omitempty"`            // per-provider overrides of the official range endpoints
+	EdgeID              map[string][]string     `json:"edgeId,omitempty"`               // per-provider IDs the edge must present (e.g. X-Azure-FDID)
+	OriginSecret        map[string]OriginSecret `json:"originSecret,omitempty"`         // per-provider shared secret header the edge must send
+	CustomProviders     []CustomProvider        `json:"customProviders,omitempty"`      // providers defined in config, included in auto
+	Fetch               FetchConfig             `json:"fetch,omitempty"`                // HTTP client for CIDR downloads
+	AutoRefresh         bool                    `json:"autoRefresh,omitempty"`          // enable periodic refresh
+	RefreshInterval     string                  `json:"refreshInterval,omitempty"`      // e.g. "12h", "1h"
+	RetryMin            string                  `json:"retryMin,omitempty"`             // first retry delay after a failed refresh, e.g. "30s"
+	RetryMax            string                  `json:"retryMax,omitempty"`             // retry delay cap, e.g. "30m"
+	FallbackPolicy      string                  `json:"fallbackPolicy,omitempty"`       // keep | private | none
+	CacheDir            string                  `json:"cacheDir,omitempty"`             // persist fetched CIDRs across restarts
+	Limits              map[string]Limits       `json:"limits,omitempty"`               // per-provider sanity checks for fetched lists
+	Debug               bool                    `json:"debug,omitempty"`
+}
+
+// CustomProvider defines a provider entirely in the middleware config.
+type CustomProvider struct {
+	Name           string   `json:"name"`
+	URLs           []string `json:"urls,omitempty"`
+	Format         string   `json:"format,omitempty"`   // lines (default) | json-array | json
+	JSONKeys       []string `json:"jsonKeys,omitempty"` // for format json, e.g. "prefixes.ipv4Prefix"
+	ClientIPHeader string   `json:"clientIpHeader"`
+	ProtoHeader    string   `json:"protoHeader,omitempty"`
+	StripHeaders   []string `json:"stripHeaders,omitempty"`
+}
+
+// Limits overrides the sanity checks applied to a provider's fetched ranges.
+// Zero values keep the provider's defaults.
+type Limits struct {
+	MinCount         int  `json:"minCount,omitempty"`
+	MaxCount         int  `json:"maxCount,omitempty"`
+	MaxShrinkPercent int  `json:"maxShrinkPercent,omitempty"` // 100 disables the check
+	MinPrefixV4      int  `json:"minPrefixV4,omitempty"`
+	MinPrefixV6      int  `json:"minPrefixV6,omitempty"`
+	AllowPrivate     bool `json:"allowPrivate,omitempty"`
+}
+
+// CloudflareTunnel trusts requests relayed by cloudflared, whose socket IP is a local
+// connector rather than a Cloudflare edge range.
+type CloudflareTunnel struct {
+	Connectors []string `json:"connectors,omitempty"` // connector source CIDRs, e.g. a Docker network
+	TunnelIDs  []string `json:"tunnelIds,omitempty"`  // if set, Cf-Warp-Tag-Id must match one of them
+}
+
+// OriginPull requires Cloudflare requests to present an Authenticated Origin Pulls client certificate.
+type OriginPull struct {
+	Enabled   bool     `json:"enabled,omitempty"`
+	CAFiles   []string `json:"caFiles,omitempty"`   // per-zone CAs (PEM); default: Cloudflare's origin-pull CA from caUrl
+	CAURL     string   `json:"caUrl,omitempty"`     // where to download Cloudflare's origin-pull CA
+	OnMissing string   `json:"onMissing,omitempty"` // untrusted (default) | reject | allow
+}
+
+// OriginSecret is a shared secret header the edge must send before its headers are
+// trusted (e.g. a CloudFront origin custom header). List several values to rotate it.
+type OriginSecret struct {
+	Header string   `json:"header,omitempty"`
+	Values []string `json:"values,omitempty"`
+}
+
+// TrustSource selects the address the trust decision is based on.
+type TrustSource struct {
+	From    string   `json:"from,omitempty"`    // socket (default) | proxyProtocol (socket, labelled) | header
+	Header  string   `json:"header,omitempty"`  // for header: set by the L4 balancer, e.g. "X-Edge-IP"
+	Proxies []string `json:"proxies,omitempty"` // for header: balancer CIDRs allowed to set it
+}
+
+// FetchConfig configures the HTTP client used for CIDR downloads.
+type FetchConfig struct {
+	ConnectTimeout string `json:"connectTimeout,omitempty"` // e.g. "10s"
+	Timeout        string `json:"timeout,omitempty"`        // whole request, e.g. "30s"
+	Proxy          string `json:"proxy,omitempty"`          // HTTP(S) proxy URL; default: environment
+	CAFile         string `json:"caFile,omitempty"`         // PEM bundle added to the system roots
+	UserAgent      string `json:"userAgent,omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
-		Provider:            providers.Auto.String(), // TODO: if no provider has been set...
-		TrustIP:             make(map[string][]string),
-                AutoRefresh:         true,
-		RefreshInterval:     "12h",
-                Debug:               false,
+		Provider:        providers.Auto.String(), // TODO: if no provider has been set...
+		TrustIP:         make(map[string][]string),
+		TrustIPFile:     make(map[string][]string),
+		ExcludeIP:       make(map[string][]string),
+		RangesURL:       make(map[string][]string),
+		EdgeID:          make(map[string][]string),
+		OriginSecret:    make(map[string]OriginSecret),
+		Limits:          make(map[string]Limits),
+		AutoRefresh:     true,
+		RefreshInterval: "12h",
+		RetryMin:        "30s",
+		RetryMax:        "30m",
+		FallbackPolicy:  "keep",
+		Fetch: FetchConfig{
+			ConnectTimeout: "10s",
+			Timeout:        "30s",
+			UserAgent:      "traefik-warp",
+		},
+		Debug: false,
 	}
 }
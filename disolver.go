@@ -1,83 +1,203 @@
 package traefik_warp
 
 import (
-	"net"
+	"crypto/tls"
+	"fmt"
 	"net/http"
-        "sync"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/l4rm4nd/traefik-warp/providers"
 )
 
-func (r *Disolver) counts() (cf, cfn int) {
-    r.mu.RLock()
-    defer r.mu.RUnlock()
-    cf = len(r.TrustIP[providers.Cloudflare])
-    cfn = len(r.TrustIP[providers.Cloudfront])
-    return
+// counts returns "provider", "n" pairs for every provider covered by the configured mode, for logging.
+// n counts prefixes after exclusions; providers with excludeIp also get a "provider.excluded" pair.
+func (r *Disolver) counts() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var kv []string
+	for _, s := range r.sources {
+		kv = append(kv, string(s.Name()), fmt.Sprintf("%d", len(r.TrustIP[s.Name()])))
+		if n := len(r.exclude[s.Name()]); n > 0 {
+			kv = append(kv, string(s.Name())+".excluded", fmt.Sprintf("%d", n))
+		}
+	}
+	return kv
 }
 
 // Disolver is a plugin that overwrites the true IP.
 type Disolver struct {
-	next               http.Handler
-	name               string
-	provider           providers.Provider
-	TrustIP            map[providers.Provider][]*net.IPNet
-	clientIPHeaderName string
-
-        mu                 sync.RWMutex               // guards TrustIP
-	userTrust          map[string][]string        // keep user-supplied CIDRs for merges on refresh
+	next     http.Handler
+	name     string
+	provider providers.Provider
+	sources  []providers.Source // sources covered by provider (all registered ones in Auto)
+	TrustIP  map[providers.Provider][]netip.Prefix
+	fetcher  *providers.Fetcher
+
+	mu            sync.RWMutex                          // guards TrustIP
+	table         atomic.Value                          // *prefixTable compiled from TrustIP, see publish
+	userTrust     map[string][]string                   // keep user-supplied CIDRs for merges on refresh
+	userTrustFile map[string][]string                   // files re-read on every refresh
+	allowAnyTrust bool                                  // permit catch-all prefixes from users
+	exclude       map[providers.Provider][]netip.Prefix // carved out of TrustIP on every rebuild
+	intermediates []netip.Prefix                        // proxies between the edge and Traefik
+	tunnel        *cloudflareTunnel                     // nil unless cloudflareTunnel is configured
+	decision      *decisionSource                       // nil = socket
+	originPull    *originPull                           // nil unless cloudflareOriginPull is enabled
+	rangesURL     map[string][]string                   // endpoint overrides per provider
+	edgeIDs       map[string][]string                   // IDs checked by providers.Verifier sources
+	secrets       map[providers.Provider]*originSecret  // shared secret headers per provider (originSecret)
+	limits        map[providers.Provider]providers.Limits
+
+	refreshMu       sync.Mutex                         // serializes rebuild
+	entries         map[providers.Provider]*rangeEntry // built-in ranges, shared via sharedRanges
+	fallbackPolicy  string
+	cacheDir        string        // on-disk CIDR cache, "" = disabled
+	refreshInterval time.Duration // cache entries younger than this are not re-fetched
+	retryMin        time.Duration // backoff after a failed refresh, doubled per failure
+	retryMax        time.Duration
+	autoRefresh     bool
+	fetchKey        string // fetch settings, part of the shared entry key
+}
+
+// urlsFor returns the configured endpoint override for s, or its official endpoints.
+func (r *Disolver) urlsFor(s providers.Source) []string {
+	if urls := r.rangesURL[string(s.Name())]; len(urls) > 0 {
+		return urls
+	}
+	return s.URLs()
 }
 
-// CFVisitorHeader definition for the header value.
-type CFVisitorHeader struct {
-	Scheme string `json:"scheme"`
+// limitsFor returns the sanity checks for fetched ranges of s.
+func (r *Disolver) limitsFor(s providers.Source) providers.Limits {
+	if l, ok := r.limits[s.Name()]; ok {
+		return l
+	}
+	return providers.LimitsFor(s)
 }
 
 // TrustResult for Trust IP test result.
 type TrustResult struct {
 	isFatal  bool
 	isError  bool
+	reject   bool // refused outright (cloudflareOriginPull onMissing=reject)
 	trusted  bool
 	directIP string
+	source   providers.Source // matched source when trusted
+	hops     int              // X-Forwarded-For entries added behind the edge (intermediate proxies)
+	via      string           // X-Warp-Trust-Source when not the resolved address itself
 }
 
-// helper: membership check with lock
-func (r *Disolver) contains(prov providers.Provider, ip net.IP) bool {
+// publish compiles TrustIP into the lookup table used by match.
+// Call after every change to TrustIP.
+func (r *Disolver) publish() {
 	r.mu.RLock()
-	nets := r.TrustIP[prov]
+	t := buildTable(r.sources, r.TrustIP)
 	r.mu.RUnlock()
-	for _, n := range nets {
-		if n.Contains(ip) {
-			return true
+	r.table.Store(t)
+}
+
+// matches returns every configured source whose ranges contain ip, first configured first.
+// It is a single lock-free lookup in the table published last.
+func (r *Disolver) matches(ip netip.Addr) []providers.Source {
+	t, _ := r.table.Load().(*prefixTable)
+	return t.lookup(ip)
+}
+
+// trust decides whether the edge peer belongs to a trusted edge network. The peer is
+// the REMOTE socket IP or, when the socket is one of intermediateProxies, the first
+// X-Forwarded-For hop (right to left) that is not an intermediate proxy.
+// Sockets of cloudflared connectors (cloudflareTunnel) are trusted as Cloudflare.
+// In Auto mode we treat trust as the UNION of all registered providers.
+// Sources implementing providers.Verifier must additionally vouch for the request,
+// and providers with an originSecret must send it. If a matching source does not
+// vouch, the next source covering the address is tried.
+func (r *Disolver) trust(remote string, req *http.Request) *TrustResult {
+	ip, ok := socketAddr(remote)
+	if !ok {
+		return &TrustResult{isError: true}
+	}
+
+	// cloudflared connectors relay Cloudflare requests from a local address.
+	if r.tunnel.isConnector(ip) {
+		if r.tunnel.verify(req) && r.verifySecret(r.tunnel.source, req) {
+			return &TrustResult{trusted: true, directIP: ip.String(), source: r.tunnel.source}
 		}
+		return &TrustResult{trusted: false, directIP: ip.String()}
 	}
-	return false
-}
 
-// trust decides whether the REMOTE socket IP belongs to a trusted edge network.
-// In Auto mode we treat trust as the UNION of Cloudflare + CloudFront.
-func (r *Disolver) trust(remote string, _ *http.Request) *TrustResult {
-	host, _, err := net.SplitHostPort(remote)
-	if err != nil {
-		host = remote
+	hops, via := 0, ""
+	if containsAddr(r.intermediates, ip) {
+		if req == nil {
+			return &TrustResult{trusted: false, directIP: ip.String()}
+		}
+		peer, n, ok := r.edgeHop(req.Header)
+		if !ok {
+			return &TrustResult{trusted: false, directIP: ip.String()}
+		}
+		ip, hops, via = peer, n, sourceForwardedFor
 	}
-	ip := net.ParseIP(host)
-	if ip == nil {
-		return &TrustResult{isError: true}
+
+	reject := false
+	for _, s := range r.matches(ip) {
+		v, ok := s.(providers.Verifier)
+		if ok && (req == nil || !v.Verify(req.Header, r.edgeIDs[string(s.Name())])) {
+			continue
+		}
+		if !r.verifySecret(s, req) {
+			continue
+		}
+		// Any Cloudflare customer can reach us from Cloudflare's ranges;
+		// Authenticated Origin Pulls prove the request came through our zone.
+		if s.Name() == providers.Cloudflare && r.originPull != nil {
+			var cs *tls.ConnectionState
+			if req != nil {
+				cs = req.TLS
+			}
+			trusted, rej := r.originPull.decide(cs)
+			if !trusted {
+				reject = reject || rej
+				continue
+			}
+		}
+		return &TrustResult{trusted: true, directIP: ip.String(), source: s, hops: hops, via: via}
 	}
+	return &TrustResult{trusted: false, reject: reject, directIP: ip.String(), hops: hops, via: via}
+}
 
-	switch r.provider {
-	case providers.Cloudflare:
-		if r.contains(providers.Cloudflare, ip) {
-			return &TrustResult{trusted: true, directIP: ip.String()}
+// verifySecret reports whether req carries the originSecret of s, if one is configured.
+func (r *Disolver) verifySecret(s providers.Source, req *http.Request) bool {
+	sec := r.secrets[s.Name()]
+	if sec == nil {
+		return true
+	}
+	return req != nil && sec.verify(req.Header)
+}
+
+// containsAddr reports whether ip is in one of prefixes.
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
 		}
-	case providers.Cloudfront:
-		if r.contains(providers.Cloudfront, ip) {
-			return &TrustResult{trusted: true, directIP: ip.String()}
+	}
+	return false
+}
+
+// edgeHop walks X-Forwarded-For right to left past intermediate proxies. It returns
+// the first other hop and how many entries (including it) were appended behind the edge.
+func (r *Disolver) edgeHop(h http.Header) (netip.Addr, int, bool) {
+	hops := forwardedForHops(h)
+	for i := len(hops) - 1; i >= 0; i-- {
+		a, ok := parseAddr(extractClientIP(hops[i]))
+		if !ok {
+			return netip.Addr{}, 0, false
 		}
-	case providers.Auto:
-		if r.contains(providers.Cloudflare, ip) || r.contains(providers.Cloudfront, ip) {
-			return &TrustResult{trusted: true, directIP: ip.String()}
+		if !containsAddr(r.intermediates, a) {
+			return a, len(hops) - i, true
 		}
 	}
-	return &TrustResult{trusted: false, directIP: ip.String()}
+	return netip.Addr{}, 0, false
 }
@@ -6,4 +6,5 @@ const (
 	xForwardProto = "X-Forwarded-Proto"
 	xWarpTrusted  = "X-Warp-Trusted"
 	xWarpProvider = "X-Warp-Provider"
+	xWarpSource   = "X-Warp-Trust-Source"
 )
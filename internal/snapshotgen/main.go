@@ -0,0 +1,76 @@
+// Command snapshotgen refreshes the compiled-in range snapshot of a provider.
+// It is run via `go generate` from the provider's package directory:
+//
+//	//go:generate go run ../../internal/snapshotgen -provider cloudflare
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+	_ "github.com/l4rm4nd/traefik-warp/providers/auto"
+)
+
+func main() {
+	name := flag.String("provider", "", "provider to snapshot")
+	out := flag.String("out", "snapshot.go", "output file")
+	timeout := flag.Duration("timeout", time.Minute, "fetch timeout")
+	flag.Parse()
+
+	s, ok := providers.Lookup(providers.Provider(*name))
+	if !ok {
+		log.Fatalf("unknown provider %q", *name)
+	}
+
+	f, err := providers.NewFetcher(providers.FetcherOptions{Timeout: *timeout})
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	cidrs, err := providers.TrustedIPS(ctx, f, s, s.URLs())
+	if err != nil {
+		log.Fatalf("fetch %s: %v", *name, err)
+	}
+	for _, c := range cidrs {
+		if _, _, err := net.ParseCIDR(c); err != nil {
+			log.Fatalf("refusing to snapshot invalid CIDR %q", c)
+		}
+	}
+	var prev []string
+	if b, ok := s.(providers.Bundled); ok {
+		prev = b.BundledIPS()
+	}
+	if err := providers.LimitsFor(s).Check(cidrs, prev); err != nil {
+		log.Fatalf("refusing to snapshot %s: %v", *name, err)
+	}
+
+	now := time.Now().UTC()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by snapshotgen; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %s\n\nimport \"time\"\n\n", *name)
+	fmt.Fprintf(&b, "// snapshotAt is when snapshot was fetched from %v.\n", s.URLs())
+	fmt.Fprintf(&b, "var snapshotAt = time.Date(%d, %d, %d, 0, 0, 0, 0, time.UTC)\n\n", now.Year(), now.Month(), now.Day())
+	fmt.Fprintf(&b, "var snapshot = []string{\n")
+	for _, c := range cidrs {
+		fmt.Fprintf(&b, "\t%q,\n", c)
+	}
+	fmt.Fprintf(&b, "}\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d ranges for %s to %s", len(cidrs), *name, *out)
+}
@@ -3,14 +3,15 @@ package traefik_warp
 import (
 	"context"
 	"fmt"
-	"net"
 	"net/http"
+	"net/netip"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/l4rm4nd/traefik-warp/providers"
-	"github.com/l4rm4nd/traefik-warp/providers/cloudflare"
-	"github.com/l4rm4nd/traefik-warp/providers/cloudfront"
+	_ "github.com/l4rm4nd/traefik-warp/providers/auto" // registers built-in providers
+	"github.com/l4rm4nd/traefik-warp/providers/custom"
 )
 
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
@@ -21,117 +22,351 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 	// enable/disable debug logging for this process
 	enableDebug(config.Debug)
 
+	customs, err := customSources(config.CustomProviders)
+	if err != nil {
+		return nil, err
+	}
+
+	fallback := strings.ToLower(strings.TrimSpace(config.FallbackPolicy))
+	switch fallback {
+	case "":
+		fallback = fallbackKeep
+	case fallbackKeep, fallbackPrivate, fallbackNone:
+	default:
+		return nil, fmt.Errorf("invalid fallbackPolicy %q (want keep, private or none)", config.FallbackPolicy)
+	}
+
+	if err := validateTrustIP(config, customs); err != nil {
+		return nil, err
+	}
+
+	fetcher, err := newFetcher(config.Fetch)
+	if err != nil {
+		return nil, err
+	}
+
 	provider := providers.Provider(config.Provider)
-	if err := provider.Validate(); err != nil {
-		return nil, fmt.Errorf("failed to validate provider %q: %w", config.Provider, err)
+	sources := providers.Resolve(provider)
+	if provider == providers.Auto {
+		sources = append(sources, customs...)
+	} else {
+		for _, c := range customs {
+			if c.Name() == provider {
+				sources = []providers.Source{c}
+			}
+		}
+	}
+	if len(sources) == 0 && provider != providers.Auto {
+		return nil, fmt.Errorf("failed to validate provider %q: %w", config.Provider, provider.Validate())
 	}
 
 	d := &Disolver{
-		next:      next,
-		name:      name,
-		provider:  provider,
-		TrustIP:   make(map[providers.Provider][]*net.IPNet),
-		userTrust: config.TrustIP, // keep user additions for merges on refresh
+		next:           next,
+		name:           name,
+		provider:       provider,
+		sources:        sources,
+		fetcher:        fetcher,
+		TrustIP:        make(map[providers.Provider][]netip.Prefix),
+		userTrust:      config.TrustIP, // keep user additions for merges on refresh
+		userTrustFile:  config.TrustIPFile,
+		allowAnyTrust:  config.AllowAnyTrust,
+		rangesURL:      config.RangesURL,
+		edgeIDs:        config.EdgeID,
+		fallbackPolicy: fallback,
+		cacheDir:       config.CacheDir,
+		autoRefresh:    config.AutoRefresh,
+		fetchKey:       fmt.Sprintf("%+v", config.Fetch),
+	}
+
+	d.exclude, err = parseExcludes(config.ExcludeIP)
+	if err != nil {
+		return nil, err
+	}
+
+	d.intermediates, err = parsePrefixList("intermediateProxies", config.IntermediateProxies, config.AllowAnyTrust)
+	if err != nil {
+		return nil, err
+	}
+
+	d.tunnel, err = newCloudflareTunnel(config.CloudflareTunnel, sources, config.AllowAnyTrust)
+	if err != nil {
+		return nil, err
 	}
 
-	switch provider {
-	case providers.Cloudflare:
-		d.clientIPHeaderName = cloudflare.ClientIPHeaderName
-	case providers.Cloudfront:
-		d.clientIPHeaderName = cloudfront.ClientIPHeaderName
+	d.decision, err = newDecisionSource(config.TrustSource, config.AllowAnyTrust)
+	if err != nil {
+		return nil, err
 	}
 
-	// Initial allowlist build
-	if err := d.refreshOnce(); err != nil {
+	d.secrets, err = newOriginSecrets(config.OriginSecret, customs)
+	if err != nil {
+		return nil, err
+	}
+
+	d.originPull, err = newOriginPull(ctx, config.OriginPull, fetcher)
+	if err != nil {
+		return nil, err
+	}
+
+	d.limits, err = resolveLimits(sources, config.Limits)
+	if err != nil {
+		return nil, err
+	}
+
+	// The interval also bounds how old cached CIDRs may be.
+	d.refreshInterval, err = time.ParseDuration(config.RefreshInterval)
+	if err != nil || d.refreshInterval <= 0 {
+		d.refreshInterval = 12 * time.Hour
+	}
+
+	d.retryMin, d.retryMax, err = retryBackoff(config.RetryMin, config.RetryMax, d.refreshInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	// Providers without built-in ranges (e.g. akamai) trust nothing until configured.
+	for _, s := range d.sources {
+		key := string(s.Name())
+		_, bundled := s.(providers.Bundled)
+		if !bundled && len(d.urlsFor(s)) == 0 && len(config.TrustIP[key]) == 0 && len(config.TrustIPFile[key]) == 0 {
+			logWarn("warp: provider has no built-in ranges; configure rangesUrl, trustip or trustipFile", "provider", key, "middleware", name)
+		}
+		// Providers with shared edge ranges (e.g. azurefrontdoor) trust nothing without an edgeId.
+		if v, ok := s.(providers.Verifier); ok && v.NeedsEdgeID() && len(config.EdgeID[key]) == 0 {
+			logWarn("warp: provider requires edgeId; its requests stay untrusted", "provider", key, "middleware", name)
+		}
+	}
+
+	// Initial allowlist build; ranges already loaded by other instances are reused.
+	// With autoRefresh, every provider is refreshed by one shared timer.
+	if err := d.load(ctx); err != nil {
 		logWarn("warp: initial CIDR load had issues", "error", err.Error(), "middleware", name)
 	} else {
-		cf, cfn := d.counts()
-		logInfo("warp: CIDRs loaded", "cf", fmt.Sprintf("%d", cf), "cfn", fmt.Sprintf("%d", cfn), "middleware", name)
+		logInfo("warp: CIDRs loaded", append(d.counts(), "middleware", name)...)
 	}
 
-	// Periodic refresh
-	if config.AutoRefresh {
-		ival, err := time.ParseDuration(config.RefreshInterval)
-		if err != nil || ival <= 0 {
-			ival = 12 * time.Hour
+	return d, nil
+}
+
+// newFetcher builds the shared CIDR download client from config.
+func newFetcher(c FetchConfig) (*providers.Fetcher, error) {
+	opts := providers.FetcherOptions{
+		Proxy:     c.Proxy,
+		CAFile:    c.CAFile,
+		UserAgent: c.UserAgent,
+	}
+	for _, t := range []struct {
+		name string
+		raw  string
+		dst  *time.Duration
+	}{
+		{"fetch.connectTimeout", c.ConnectTimeout, &opts.ConnectTimeout},
+		{"fetch.timeout", c.Timeout, &opts.Timeout},
+	} {
+		if t.raw == "" {
+			continue
 		}
-		go d.refreshLoop(ctx, ival)
+		v, err := time.ParseDuration(t.raw)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", t.name, t.raw)
+		}
+		*t.dst = v
 	}
 
-	return d, nil
+	f, err := providers.NewFetcher(opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fetch config: %w", err)
+	}
+	return f, nil
 }
 
-// refreshLoop periodically refreshes the allowlists until ctx is done.
-func (d *Disolver) refreshLoop(ctx context.Context, interval time.Duration) {
-	jitter := time.Duration(int64(time.Second) * (int64(time.Now().UnixNano())%7))
-	t := time.NewTimer(interval + jitter)
-	defer t.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-t.C:
-			if err := d.refreshOnce(); err != nil {
-				logWarn("warp: periodic CIDR refresh failed", "error", err.Error())
-			} else {
-				cf, cfn := d.counts()
-				logInfo("warp: refreshed CIDRs", "cf", fmt.Sprintf("%d", cf), "cfn", fmt.Sprintf("%d", cfn))
-			}
-			t.Reset(interval)
+// retryBackoff parses the retry bounds, capping them at the refresh interval.
+func retryBackoff(minRaw, maxRaw string, interval time.Duration) (min, max time.Duration, err error) {
+	min, max = 30*time.Second, 30*time.Minute
+	for _, t := range []struct {
+		name string
+		raw  string
+		dst  *time.Duration
+	}{
+		{"retryMin", minRaw, &min},
+		{"retryMax", maxRaw, &max},
+	} {
+		if t.raw == "" {
+			continue
+		}
+		v, err := time.ParseDuration(t.raw)
+		if err != nil || v <= 0 {
+			return 0, 0, fmt.Errorf("invalid %s %q", t.name, t.raw)
 		}
+		*t.dst = v
 	}
+	if max > interval {
+		max = interval
+	}
+	if min > max {
+		min = max
+	}
+	return min, max, nil
 }
 
-// refreshOnce fetches defaults + merges user-supplied CIDRs, then swaps atomically.
-func (d *Disolver) refreshOnce() error {
-	// Fetch defaults depending on configured provider
-	var cfCIDRs, cfnCIDRs []string
-	switch d.provider {
-	case providers.Cloudflare:
-		cfCIDRs = cloudflare.TrustedIPS()
-	case providers.Cloudfront:
-		cfnCIDRs = cloudfront.TrustedIPS()
-	case providers.Auto:
-		cfCIDRs = cloudflare.TrustedIPS()
-		cfnCIDRs = cloudfront.TrustedIPS()
+// validateTrustIP checks trustip (and the keys of the other per-provider maps) before anything is
+// trusted: every key must name a provider, so typos do not silently drop settings, every entry must be a CIDR or bare IP, and
+// catch-all prefixes need allowAnyTrust. All problems are reported at once.
+func validateTrustIP(config *Config, customs []providers.Source) error {
+	known := make(map[string]bool)
+	for _, s := range append(providers.Sources(), customs...) {
+		known[string(s.Name())] = true
 	}
 
-	// Merge user-provided extras
-	if list, ok := d.userTrust[providers.Cloudflare.String()]; ok {
-		cfCIDRs = append(cfCIDRs, list...)
+	var problems []string
+	limitKeys := make(map[string][]string, len(config.Limits))
+	for k := range config.Limits {
+		limitKeys[k] = nil
 	}
-	if list, ok := d.userTrust[providers.Cloudfront.String()]; ok {
-		cfnCIDRs = append(cfnCIDRs, list...)
+	for _, m := range []struct {
+		name string
+		keys map[string][]string
+	}{
+		{"trustip", config.TrustIP},
+		{"trustipFile", config.TrustIPFile},
+		{"excludeIp", config.ExcludeIP},
+		{"rangesUrl", config.RangesURL},
+		{"edgeId", config.EdgeID},
+		{"limits", limitKeys},
+	} {
+		for _, key := range sortedKeys(m.keys) {
+			if !known[key] {
+				problems = append(problems, fmt.Sprintf("%s: unknown provider %q", m.name, key))
+			}
+		}
 	}
 
-	// Build a fresh map
-	newMap := make(map[providers.Provider][]*net.IPNet)
-	add := func(p providers.Provider, cidrs []string) {
-		for _, v := range cidrs {
+	for _, key := range sortedKeys(config.TrustIP) {
+		for _, v := range config.TrustIP[key] {
 			c := strings.TrimSpace(v)
-			if c == "" {
-				continue
+			n, err := parseCIDROrIP(c)
+			switch {
+			case err != nil:
+				problems = append(problems, fmt.Sprintf("trustip.%s: invalid CIDR or IP %q", key, v))
+			case n.Bits() == 0 && !config.AllowAnyTrust:
+				problems = append(problems, fmt.Sprintf("trustip.%s: %q trusts every address (set allowAnyTrust to permit)", key, c))
 			}
-			_, n, err := net.ParseCIDR(c)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid provider config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// parseExcludes parses excludeIp; keys were checked by validateTrustIP.
+func parseExcludes(m map[string][]string) (map[providers.Provider][]netip.Prefix, error) {
+	out := make(map[providers.Provider][]netip.Prefix, len(m))
+	var bad []string
+	for _, key := range sortedKeys(m) {
+		for _, v := range m[key] {
+			n, err := parseCIDROrIP(strings.TrimSpace(v))
 			if err != nil {
+				bad = append(bad, fmt.Sprintf("excludeIp.%s: invalid CIDR or IP %q", key, v))
 				continue
 			}
-			newMap[p] = append(newMap[p], n)
+			out[providers.Provider(key)] = append(out[providers.Provider(key)], n)
 		}
 	}
+	if len(bad) > 0 {
+		return nil, fmt.Errorf("invalid excludeIp config: %s", strings.Join(bad, "; "))
+	}
+	return out, nil
+}
 
-	if len(cfCIDRs) > 0 {
-		add(providers.Cloudflare, cfCIDRs)
+// parsePrefixList parses a CIDR/IP list of the config field name, such as intermediateProxies;
+// catch-all prefixes need allowAnyTrust. All problems are reported at once.
+func parsePrefixList(field string, list []string, allowAny bool) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	var bad []string
+	for _, v := range list {
+		n, err := parseCIDROrIP(strings.TrimSpace(v))
+		switch {
+		case err != nil:
+			bad = append(bad, fmt.Sprintf("invalid CIDR or IP %q", v))
+		case n.Bits() == 0 && !allowAny:
+			bad = append(bad, fmt.Sprintf("%q trusts every address (set allowAnyTrust to permit)", v))
+		default:
+			out = append(out, n)
+		}
 	}
-	if len(cfnCIDRs) > 0 {
-		add(providers.Cloudfront, cfnCIDRs)
+	if len(bad) > 0 {
+		return nil, fmt.Errorf("invalid %s config: %s", field, strings.Join(bad, "; "))
 	}
+	return out, nil
+}
 
-	// Swap atomically
-	d.mu.Lock()
-	d.TrustIP = newMap
-	d.mu.Unlock()
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
 
-	return nil
+// resolveLimits merges per-provider overrides into the defaults of each source.
+func resolveLimits(sources []providers.Source, overrides map[string]Limits) (map[providers.Provider]providers.Limits, error) {
+	out := make(map[providers.Provider]providers.Limits, len(sources))
+	for _, s := range sources {
+		l := providers.LimitsFor(s)
+		o, ok := overrides[string(s.Name())]
+		if !ok {
+			out[s.Name()] = l
+			continue
+		}
+		if o.MinCount < 0 || o.MaxCount < 0 || o.MinPrefixV4 < 0 || o.MinPrefixV4 > 32 ||
+			o.MinPrefixV6 < 0 || o.MinPrefixV6 > 128 || o.MaxShrinkPercent < 0 || o.MaxShrinkPercent > 100 {
+			return nil, fmt.Errorf("invalid limits for provider %q", s.Name())
+		}
+		for _, f := range []struct{ src, dst *int }{
+			{&o.MinCount, &l.MinCount},
+			{&o.MaxCount, &l.MaxCount},
+			{&o.MaxShrinkPercent, &l.MaxShrinkPct},
+			{&o.MinPrefixV4, &l.MinPrefixV4},
+			{&o.MinPrefixV6, &l.MinPrefixV6},
+		} {
+			if *f.src != 0 {
+				*f.dst = *f.src
+			}
+		}
+		l.AllowPrivate = l.AllowPrivate || o.AllowPrivate
+		if l.MaxCount > 0 && l.MinCount > l.MaxCount {
+			return nil, fmt.Errorf("invalid limits for provider %q: minCount %d > maxCount %d", s.Name(), l.MinCount, l.MaxCount)
+		}
+		out[s.Name()] = l
+	}
+	return out, nil
+}
+
+// customSources builds the providers defined in config, rejecting duplicate names.
+func customSources(defs []CustomProvider) ([]providers.Source, error) {
+	var out []providers.Source
+	seen := make(map[providers.Provider]bool)
+	for _, def := range defs {
+		s, err := custom.New(custom.Spec{
+			Name:           def.Name,
+			URLs:           def.URLs,
+			Format:         def.Format,
+			JSONKeys:       def.JSONKeys,
+			ClientIPHeader: def.ClientIPHeader,
+			ProtoHeader:    def.ProtoHeader,
+			StripHeaders:   def.StripHeaders,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid customProviders entry: %w", err)
+		}
+		if seen[s.Name()] {
+			return nil, fmt.Errorf("invalid customProviders entry: duplicate name %q", s.Name())
+		}
+		seen[s.Name()] = true
+		out = append(out, s)
+	}
+	return out, nil
 }
@@ -0,0 +1,444 @@
+package traefik_warp
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+	"github.com/l4rm4nd/traefik-warp/providers/akamai"
+	"github.com/l4rm4nd/traefik-warp/providers/azurefrontdoor"
+	"github.com/l4rm4nd/traefik-warp/providers/fastly"
+)
+
+func Test_Akamai_NoBuiltinRanges_UntrustedByDefault(t *testing.T) {
+	d := &Disolver{
+		next:     captureNext{},
+		name:     "test",
+		provider: akamai.Name,
+		sources:  providers.Resolve(akamai.Name),
+		TrustIP:  make(map[providers.Provider][]netip.Prefix),
+	}
+	if err := loadRanges(t, d); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if n := len(d.TrustIP[akamai.Name]); n != 0 {
+		t.Fatalf("expected no akamai ranges, got %d", n)
+	}
+	if res := d.trust("192.168.1.1:443", nil); res.trusted {
+		t.Fatalf("private socket must not be trusted without configured ranges")
+	}
+}
+
+func Test_Akamai_TrustFromConfigAndFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "siteshield.txt")
+	body := "# SiteShield map\n192.0.2.0/24\n\n2001:db8::/32 # v6\n"
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Disolver{
+		next:          captureNext{},
+		name:          "test",
+		provider:      akamai.Name,
+		sources:       providers.Resolve(akamai.Name),
+		TrustIP:       make(map[providers.Provider][]netip.Prefix),
+		userTrust:     map[string][]string{"akamai": {"198.51.100.0/24"}},
+		userTrustFile: map[string][]string{"akamai": {path}},
+	}
+	if err := loadRanges(t, d); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if n := len(d.TrustIP[akamai.Name]); n != 3 {
+		t.Fatalf("expected 3 akamai ranges, got %d", n)
+	}
+	for _, remote := range []string{"198.51.100.1:443", "192.0.2.9:443", "[2001:db8::1]:443"} {
+		res := d.trust(remote, nil)
+		if !res.trusted || res.source.Name() != akamai.Name {
+			t.Fatalf("%s: expected trusted akamai, got %+v", remote, res)
+		}
+	}
+}
+
+func Test_TrustIPFile_MissingFileReported(t *testing.T) {
+	d := &Disolver{
+		provider:      akamai.Name,
+		sources:       providers.Resolve(akamai.Name),
+		TrustIP:       make(map[providers.Provider][]netip.Prefix),
+		userTrustFile: map[string][]string{"akamai": {filepath.Join(t.TempDir(), "missing.txt")}},
+	}
+	if err := loadRanges(t, d); err == nil {
+		t.Fatalf("expected error for missing trustipFile")
+	}
+}
+
+func Test_ParseCIDROrIP_AcceptsBareIPs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"192.0.2.0/24", "192.0.2.0/24"},
+		{"192.0.2.7", "192.0.2.7/32"},
+		{"2001:db8::7", "2001:db8::7/128"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"192.0.2.7/24", "192.0.2.0/24"},
+		{"::ffff:192.0.2.0/120", "192.0.2.0/24"},
+		{"::ffff:192.0.2.7", "192.0.2.7/32"},
+	}
+	for _, tc := range tests {
+		n, err := parseCIDROrIP(tc.in)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.in, err)
+		}
+		if n.String() != tc.want {
+			t.Fatalf("%q: want %s got %s", tc.in, tc.want, n)
+		}
+	}
+	for _, bad := range []string{"garbage", "192.0.2.0/33", "300.1.1.1"} {
+		if _, err := parseCIDROrIP(bad); err == nil {
+			t.Fatalf("%q: expected error", bad)
+		}
+	}
+}
+
+func Test_Bundled_UsedWithoutEndpoint(t *testing.T) {
+	for _, p := range []providers.Provider{"sucuri", "imperva"} {
+		d := &Disolver{
+			provider: p,
+			sources:  providers.Resolve(p),
+			TrustIP:  make(map[providers.Provider][]netip.Prefix),
+		}
+		if err := loadRanges(t, d); err != nil {
+			t.Fatalf("%s: load: %v", p, err)
+		}
+		if len(d.TrustIP[p]) == 0 {
+			t.Fatalf("%s: expected bundled ranges", p)
+		}
+	}
+}
+
+func Test_CustomProvider_FromConfig(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Provider = "keycdn"
+	cfg.AutoRefresh = false
+	cfg.CustomProviders = []CustomProvider{{
+		Name:           "keycdn",
+		ClientIPHeader: "X-KeyCDN-Client-IP",
+		StripHeaders:   []string{"X-KeyCDN-Country"},
+	}}
+	cfg.TrustIP["keycdn"] = []string{"192.0.2.0/24"}
+
+	h, err := New(context.Background(), captureNext{}, cfg, "test")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://example.test/", nil)
+	req.RemoteAddr = "192.0.2.10:443"
+	req.Header.Set("X-KeyCDN-Client-IP", "4.4.4.4")
+	h.ServeHTTP(rr, req)
+
+	if got := rr.Header().Get("Got-XRIP"); got != "4.4.4.4" {
+		t.Fatalf("X-Real-IP=%q", got)
+	}
+	if got := rr.Header().Get("Got-Warp-Provider"); got != "keycdn" {
+		t.Fatalf("X-Warp-Provider=%q", got)
+	}
+}
+
+func Test_CustomProvider_InvalidDefinitions(t *testing.T) {
+	tests := []struct {
+		name string
+		defs []CustomProvider
+	}{
+		{name: "missing name", defs: []CustomProvider{{ClientIPHeader: "X-Client"}}},
+		{name: "missing header", defs: []CustomProvider{{Name: "gcore"}}},
+		{name: "built-in clash", defs: []CustomProvider{{Name: "cloudflare", ClientIPHeader: "X-Client"}}},
+		{name: "reserved name", defs: []CustomProvider{{Name: "auto", ClientIPHeader: "X-Client"}}},
+		{name: "path in name", defs: []CustomProvider{{Name: "../gcore", ClientIPHeader: "X-Client"}}},
+		{name: "space in name", defs: []CustomProvider{{Name: "g core", ClientIPHeader: "X-Client"}}},
+		{name: "json without keys", defs: []CustomProvider{{Name: "gcore", ClientIPHeader: "X-Client", Format: "json"}}},
+		{name: "unknown format", defs: []CustomProvider{{Name: "gcore", ClientIPHeader: "X-Client", Format: "xml"}}},
+		{name: "duplicate", defs: []CustomProvider{
+			{Name: "gcore", ClientIPHeader: "X-Client"},
+			{Name: "GCore", ClientIPHeader: "X-Client"},
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := customSources(tc.defs); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
+
+func Test_CustomProvider_ListFormats(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		keys   []string
+		body   string
+		want   int
+	}{
+		{name: "lines", body: "192.0.2.0/24\n# comment\n2001:db8::/32\n", want: 2},
+		{name: "json array", format: "json-array", body: `["192.0.2.0/24","198.51.100.1"]`, want: 2},
+		{name: "json keys", format: "json", keys: []string{"addresses", "$.data.v6[*]"},
+			body: `{"addresses":["192.0.2.0/24"],"data":{"v6":["2001:db8::/32","2001:db9::/32"]}}`, want: 3},
+		{name: "json keys through arrays", format: "json", keys: []string{"prefixes[].ipv4Prefix"},
+			body: `{"prefixes":[{"ipv4Prefix":"192.0.2.0/24"},{"ipv6Prefix":"2001:db8::/32"}]}`, want: 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := customSources([]CustomProvider{{Name: "cdn77", ClientIPHeader: "X-Client", Format: tc.format, JSONKeys: tc.keys}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s[0].Parse([]byte(tc.body))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if len(got) != tc.want {
+				t.Fatalf("want %d entries, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_AzureFrontDoor_ParseServiceTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "backend tag selected", body: `{"changeNumber":1,"values":[
+			{"name":"AzureFrontDoor.Frontend","properties":{"addressPrefixes":["203.0.113.0/24"]}},
+			{"name":"AzureFrontDoor.Backend","properties":{"addressPrefixes":["192.0.2.0/24","2001:db8::/32"]}},
+			{"name":"AzureCloud","properties":{"addressPrefixes":["198.51.100.0/24"]}}]}`,
+			want: []string{"192.0.2.0/24", "2001:db8::/32"}},
+		{name: "tag missing", body: `{"values":[{"name":"AzureFrontDoor.Frontend","properties":{"addressPrefixes":["203.0.113.0/24"]}}]}`, wantErr: true},
+		{name: "no values", body: `{}`, wantErr: true},
+		{name: "not json", body: "192.0.2.0/24\n", wantErr: true},
+	}
+	s := providers.Resolve(azurefrontdoor.Name)[0]
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := s.Parse([]byte(tc.body))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_Fastly_Parse(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "v4 and v6", body: `{"addresses":["192.0.2.0/24","198.51.100.0/24"],"ipv6_addresses":["2001:db8::/32"]}`,
+			want: []string{"192.0.2.0/24", "198.51.100.0/24", "2001:db8::/32"}},
+		{name: "v4 only", body: `{"addresses":["192.0.2.0/24"]}`, want: []string{"192.0.2.0/24"}},
+		{name: "v6 only", body: `{"ipv6_addresses":["2001:db8::/32"]}`, want: []string{"2001:db8::/32"}},
+		{name: "empty document", body: `{}`, wantErr: true},
+		{name: "empty lists", body: `{"addresses":[],"ipv6_addresses":[]}`, wantErr: true},
+		{name: "not json", body: "<html>", wantErr: true},
+	}
+	s := providers.Resolve(fastly.Name)[0]
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := s.Parse([]byte(tc.body))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_Fetcher_UserAgentAndContext(t *testing.T) {
+	var gotUA string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUA = r.Header.Get("User-Agent")
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer srv.Close()
+
+	f, err := newFetcher(FetchConfig{Timeout: "5s", UserAgent: "warp-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := customSources([]CustomProvider{{Name: "examplecdn", URLs: []string{srv.URL}, ClientIPHeader: "X-Client"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Disolver{provider: "examplecdn", sources: s, fetcher: f, TrustIP: make(map[providers.Provider][]netip.Prefix),
+		limits: map[providers.Provider]providers.Limits{"examplecdn": feedLimits()}}
+
+	if err := loadRanges(t, d); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if gotUA != "warp-test" {
+		t.Fatalf("User-Agent=%q", gotUA)
+	}
+	if n := len(d.TrustIP["examplecdn"]); n != 1 {
+		t.Fatalf("expected 1 range, got %d", n)
+	}
+}
+
+func Test_Fetcher_HungEndpointTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	f, err := newFetcher(FetchConfig{Timeout: "200ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, _, err := f.Get(context.Background(), srv.URL); err == nil {
+		t.Fatalf("expected timeout error")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("timeout not honored")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := f.Get(ctx, srv.URL); err == nil {
+		t.Fatalf("expected error for cancelled context")
+	}
+}
+
+func Test_Fetcher_OversizedBodyRefused(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := bytes.Repeat([]byte("192.0.2.0/24\n"), 64<<10)
+		for n := 0; n <= providers.MaxBodySize; n += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	if _, _, err := (*providers.Fetcher)(nil).Get(context.Background(), srv.URL); err == nil {
+		t.Fatalf("expected error for a body over %d bytes", providers.MaxBodySize)
+	}
+}
+
+func Test_NewFetcher_InvalidConfig(t *testing.T) {
+	for _, c := range []FetchConfig{
+		{Timeout: "soon"},
+		{ConnectTimeout: "-1s"},
+		{Proxy: "::not a url"},
+		{CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		if _, err := newFetcher(c); err == nil {
+			t.Fatalf("%+v: expected error", c)
+		}
+	}
+}
+
+func Test_TrustIP_ValidatedAtStartup(t *testing.T) {
+	tests := []struct {
+		name      string
+		trust     map[string][]string
+		allowAny  bool
+		wantErr   []string // substrings of the error
+		wantTrust string   // socket trusted after New
+	}{
+		{name: "valid", trust: map[string][]string{"cloudflare": {"198.51.100.0/24", "192.0.2.7", " 2001:db8::/32 "}}, wantTrust: "192.0.2.7"},
+		{name: "typo key", trust: map[string][]string{"cloudfare": {"198.51.100.0/24"}}, wantErr: []string{`unknown provider "cloudfare"`}},
+		{name: "bad entries", trust: map[string][]string{"cloudflare": {"198.51.100.0/33", "nope"}},
+			wantErr: []string{`"198.51.100.0/33"`, `"nope"`}},
+		{name: "any v4", trust: map[string][]string{"cloudflare": {"0.0.0.0/0"}}, wantErr: []string{`"0.0.0.0/0"`, "allowAnyTrust"}},
+		{name: "any v6", trust: map[string][]string{"fastly": {"::/0"}}, wantErr: []string{`"::/0"`}},
+		{name: "any allowed", trust: map[string][]string{"cloudflare": {"0.0.0.0/0"}}, allowAny: true, wantTrust: "203.0.113.9"},
+		{name: "custom provider key", trust: map[string][]string{"examplecdn": {"192.0.2.0/24"}}, wantTrust: "192.0.2.1"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.AutoRefresh = false
+			cfg.TrustIP = tc.trust
+			cfg.AllowAnyTrust = tc.allowAny
+			cfg.CustomProviders = []CustomProvider{{Name: "examplecdn", ClientIPHeader: "X-Client"}}
+			cfg.RangesURL = map[string][]string{}
+			for _, s := range providers.Sources() {
+				cfg.RangesURL[string(s.Name())] = []string{"http://127.0.0.1:1/"} // keep the test offline
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			h, err := New(ctx, captureNext{}, cfg, "test")
+			if len(tc.wantErr) > 0 {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				for _, want := range tc.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Fatalf("error %q does not mention %s", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			if !h.(*Disolver).trust(tc.wantTrust+":443", nil).trusted {
+				t.Fatalf("%s not trusted", tc.wantTrust)
+			}
+		})
+	}
+}
+
+func Test_TrustIPFile_CatchAllRefused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "any.txt")
+	if err := os.WriteFile(path, []byte("0.0.0.0/0\n192.0.2.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := &Disolver{
+		provider:      akamai.Name,
+		sources:       providers.Resolve(akamai.Name),
+		TrustIP:       make(map[providers.Provider][]netip.Prefix),
+		userTrustFile: map[string][]string{"akamai": {path}},
+	}
+	if err := loadRanges(t, d); err == nil || !strings.Contains(err.Error(), "allowAnyTrust") {
+		t.Fatalf("expected catch-all to be refused, got %v", err)
+	}
+	if d.trust("203.0.113.9:443", nil).trusted || !d.trust("192.0.2.1:443", nil).trusted {
+		t.Fatalf("only the specific range should be trusted")
+	}
+}
@@ -0,0 +1,98 @@
+package traefik_warp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+	"github.com/l4rm4nd/traefik-warp/providers/cloudflare"
+)
+
+// Actions for Cloudflare requests without an origin-pull client certificate.
+const (
+	onMissingUntrusted = "untrusted" // treat as untrusted (default)
+	onMissingReject    = "reject"    // answer 403
+	onMissingAllow     = "allow"     // trust by IP alone
+)
+
+// originPull verifies Cloudflare Authenticated Origin Pulls client certificates.
+type originPull struct {
+	roots     *x509.CertPool
+	onMissing string
+}
+
+// newOriginPull builds the verifier from config, or returns nil when it is disabled.
+// Without caFiles, Cloudflare's origin-pull CA is downloaded with f.
+func newOriginPull(ctx context.Context, c OriginPull, f *providers.Fetcher) (*originPull, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	op := &originPull{roots: x509.NewCertPool(), onMissing: strings.ToLower(strings.TrimSpace(c.OnMissing))}
+	switch op.onMissing {
+	case "":
+		op.onMissing = onMissingUntrusted
+	case onMissingUntrusted, onMissingReject, onMissingAllow:
+	default:
+		return nil, fmt.Errorf("invalid cloudflareOriginPull.onMissing %q (want untrusted, reject or allow)", c.OnMissing)
+	}
+
+	for _, path := range c.CAFiles {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read cloudflareOriginPull CA: %w", err)
+		}
+		if !op.roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in cloudflareOriginPull CA %q", path)
+		}
+	}
+	if len(c.CAFiles) == 0 {
+		url := c.CAURL
+		if url == "" {
+			url = cloudflare.OriginPullCAURL
+		}
+		pem, _, err := f.Get(ctx, url)
+		if err != nil {
+			return nil, fmt.Errorf("download cloudflareOriginPull CA (set caFiles to use a local copy): %w", err)
+		}
+		if !op.roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in cloudflareOriginPull CA from %s", url)
+		}
+	}
+	return op, nil
+}
+
+// verify reports whether the client certificate of cs chains to the configured CAs,
+// and whether a certificate was presented at all.
+func (op *originPull) verify(cs *tls.ConnectionState) (ok, present bool) {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return false, false
+	}
+	inter := x509.NewCertPool()
+	for _, c := range cs.PeerCertificates[1:] {
+		inter.AddCert(c)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         op.roots,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil, true
+}
+
+// decide applies the verification result: whether to trust the request, or reject it.
+// Invalid certificates are untrusted; missing ones follow onMissing.
+func (op *originPull) decide(cs *tls.ConnectionState) (trust, reject bool) {
+	if op == nil {
+		return true, false
+	}
+	ok, present := op.verify(cs)
+	if present {
+		return ok, false
+	}
+	return op.onMissing == onMissingAllow, op.onMissing == onMissingReject
+}
@@ -0,0 +1,177 @@
+package traefik_warp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+// testCA issues client certificates for origin-pull tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (ca *testCA) clientCert(t *testing.T) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "origin-pull.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func Test_OriginPull_RequiresClientCertificate(t *testing.T) {
+	ca := newTestCA(t, "Origin Pull CA")
+	other := newTestCA(t, "Someone else")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		onMissing   string
+		provider    providers.Provider
+		cert        *x509.Certificate
+		noTLS       bool
+		wantCode    int
+		wantTrusted string
+	}{
+		{name: "valid certificate", cert: ca.clientCert(t), wantCode: 200, wantTrusted: "yes"},
+		{name: "foreign certificate", cert: other.clientCert(t), wantCode: 200, wantTrusted: "no"},
+		{name: "missing, default untrusted", wantCode: 200, wantTrusted: "no"},
+		{name: "missing, plain http", noTLS: true, wantCode: 200, wantTrusted: "no"},
+		{name: "missing, reject", onMissing: "reject", wantCode: 403},
+		{name: "missing, allow", onMissing: "allow", wantCode: 200, wantTrusted: "yes"},
+		{name: "foreign certificate, allow", onMissing: "allow", cert: other.clientCert(t), wantCode: 200, wantTrusted: "no"},
+		{name: "other providers unaffected", provider: providers.Cloudfront, wantCode: 200, wantTrusted: "yes"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			op, err := newOriginPull(context.Background(), OriginPull{Enabled: true, CAFiles: []string{caFile}, OnMissing: tc.onMissing}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := newTestDisolver(providers.Auto)
+			d.originPull = op
+			d.TrustIP[providers.Cloudflare] = append(d.TrustIP[providers.Cloudflare], mustCIDR(t, "198.51.100.0/24"))
+			d.TrustIP[providers.Cloudfront] = append(d.TrustIP[providers.Cloudfront], mustCIDR(t, "203.0.113.0/24"))
+			d.publish()
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "https://example.test/", nil)
+			req.RemoteAddr = "198.51.100.10:443"
+			if tc.provider == providers.Cloudfront {
+				req.RemoteAddr = "203.0.113.10:443"
+			}
+			if tc.noTLS {
+				req.TLS = nil
+			} else if tc.cert != nil {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tc.cert}}
+			}
+			d.ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantCode {
+				t.Fatalf("status=%d, want %d", rr.Code, tc.wantCode)
+			}
+			if tc.wantCode != 200 {
+				return
+			}
+			if got := rr.Header().Get("Got-Warp-Trusted"); got != tc.wantTrusted {
+				t.Fatalf("X-Warp-Trusted=%q, want %q", got, tc.wantTrusted)
+			}
+		})
+	}
+}
+
+func Test_OriginPull_Config(t *testing.T) {
+	if op, err := newOriginPull(context.Background(), OriginPull{}, nil); op != nil || err != nil {
+		t.Fatalf("disabled: %v, %v", op, err)
+	}
+
+	ca := newTestCA(t, "Origin Pull CA")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ca.pem" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(ca.pem)
+	}))
+	defer srv.Close()
+
+	op, err := newOriginPull(context.Background(), OriginPull{Enabled: true, CAURL: srv.URL + "/ca.pem"}, nil)
+	if err != nil {
+		t.Fatalf("download CA: %v", err)
+	}
+	if ok, _ := op.verify(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{ca.clientCert(t)}}); !ok {
+		t.Fatalf("downloaded CA not used")
+	}
+
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for name, cfg := range map[string]OriginPull{
+		"bad action":      {Enabled: true, CAFiles: []string{notPEM}, OnMissing: "ignore"},
+		"missing file":    {Enabled: true, CAFiles: []string{filepath.Join(t.TempDir(), "nope.pem")}},
+		"not PEM":         {Enabled: true, CAFiles: []string{notPEM}},
+		"download failed": {Enabled: true, CAURL: srv.URL + "/missing.pem"},
+	} {
+		if _, err := newOriginPull(context.Background(), cfg, nil); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package traefik_warp
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+// originSecret is a shared secret the edge adds to every request, e.g. a CloudFront
+// origin custom header. Several values may be accepted at once to allow rotation.
+type originSecret struct {
+	header string
+	sums   [][sha256.Size]byte // digests of the accepted values
+}
+
+// newOriginSecrets builds the per-provider secrets from config.
+// Keys must name known providers, and every secret needs a header and at least one value.
+func newOriginSecrets(m map[string]OriginSecret, customs []providers.Source) (map[providers.Provider]*originSecret, error) {
+	known := make(map[string]bool)
+	for _, s := range append(providers.Sources(), customs...) {
+		known[string(s.Name())] = true
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make(map[providers.Provider]*originSecret, len(m))
+	var bad []string
+	for _, key := range keys {
+		c := m[key]
+		if !known[key] {
+			bad = append(bad, fmt.Sprintf("unknown provider %q", key))
+			continue
+		}
+		s := &originSecret{header: http.CanonicalHeaderKey(strings.TrimSpace(c.Header))}
+		if s.header == "" || strings.ContainsAny(s.header, " \t:") {
+			bad = append(bad, fmt.Sprintf("%s: invalid header %q", key, c.Header))
+		}
+		for _, v := range c.Values {
+			if v == "" {
+				bad = append(bad, fmt.Sprintf("%s: empty value", key))
+				continue
+			}
+			s.sums = append(s.sums, sha256.Sum256([]byte(v)))
+		}
+		if len(c.Values) == 0 {
+			bad = append(bad, fmt.Sprintf("%s: no values", key))
+		}
+		out[providers.Provider(key)] = s
+	}
+	if len(bad) > 0 {
+		return nil, fmt.Errorf("invalid originSecret config: %s", strings.Join(bad, "; "))
+	}
+	return out, nil
+}
+
+// verify reports whether h carries exactly one value of the secret header and it matches
+// an accepted value. Digests are compared in constant time, and every accepted value is
+// checked, so neither the value nor its length leaks through timing.
+func (s *originSecret) verify(h http.Header) bool {
+	if s == nil {
+		return true
+	}
+	vals := h.Values(s.header)
+	if len(vals) != 1 {
+		return false
+	}
+	got := sha256.Sum256([]byte(vals[0]))
+	match := 0
+	for _, want := range s.sums {
+		match |= subtle.ConstantTimeCompare(got[:], want[:])
+	}
+	return match == 1
+}
+
+// stripOriginSecrets removes every configured secret header, so secrets never reach next.
+func (r *Disolver) stripOriginSecrets(h http.Header) {
+	for _, s := range r.secrets {
+		h.Del(s.header)
+	}
+}
@@ -0,0 +1,94 @@
+package traefik_warp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+type echoOriginSecret struct{ captureNext }
+
+func (n echoOriginSecret) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Got-Origin-Secret", r.Header.Get("X-Origin-Secret"))
+	n.captureNext.ServeHTTP(w, r)
+}
+
+func Test_OriginSecret_GatesProviderHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		remoteAddr  string
+		secrets     []string
+		wantIP      string
+		wantTrusted string
+	}{
+		{name: "current secret", remoteAddr: "203.0.113.10:443", secrets: []string{"s3cret-new"}, wantIP: "5.6.7.8", wantTrusted: "yes"},
+		{name: "previous secret during rotation", remoteAddr: "203.0.113.10:443", secrets: []string{"s3cret-old"}, wantIP: "5.6.7.8", wantTrusted: "yes"},
+		{name: "wrong secret", remoteAddr: "203.0.113.10:443", secrets: []string{"s3cret"}, wantIP: "203.0.113.10", wantTrusted: "no"},
+		{name: "missing secret", remoteAddr: "203.0.113.10:443", wantIP: "203.0.113.10", wantTrusted: "no"},
+		{name: "secret sent twice", remoteAddr: "203.0.113.10:443", secrets: []string{"s3cret-new", "s3cret-new"}, wantIP: "203.0.113.10", wantTrusted: "no"},
+		{name: "other providers unaffected", remoteAddr: "198.51.100.10:443", wantIP: "1.2.3.4", wantTrusted: "yes"},
+	}
+
+	secrets, err := newOriginSecrets(map[string]OriginSecret{
+		"cloudfront": {Header: "x-origin-secret", Values: []string{"s3cret-new", "s3cret-old"}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestDisolver(providers.Auto)
+			d.next = echoOriginSecret{}
+			d.secrets = secrets
+			d.TrustIP[providers.Cloudfront] = append(d.TrustIP[providers.Cloudfront], mustCIDR(t, "203.0.113.0/24"))
+			d.TrustIP[providers.Cloudflare] = append(d.TrustIP[providers.Cloudflare], mustCIDR(t, "198.51.100.0/24"))
+			d.publish()
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://example.test/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set("Cloudfront-Viewer-Address", "5.6.7.8:5555")
+			req.Header.Set("CF-Connecting-IP", "1.2.3.4")
+			for _, v := range tc.secrets {
+				req.Header.Add("X-Origin-Secret", v)
+			}
+			d.ServeHTTP(rr, req)
+
+			if got := rr.Header().Get("Got-XRIP"); got != tc.wantIP {
+				t.Fatalf("X-Real-IP=%q, want %q", got, tc.wantIP)
+			}
+			if got := rr.Header().Get("Got-Warp-Trusted"); got != tc.wantTrusted {
+				t.Fatalf("X-Warp-Trusted=%q, want %q", got, tc.wantTrusted)
+			}
+			if got := rr.Header().Get("Got-Origin-Secret"); got != "" {
+				t.Fatalf("secret header reached next: %q", got)
+			}
+		})
+	}
+}
+
+func Test_OriginSecret_Config(t *testing.T) {
+	for name, m := range map[string]map[string]OriginSecret{
+		"unknown provider": {"cdnx": {Header: "X-Origin-Secret", Values: []string{"a"}}},
+		"no header":        {"cloudfront": {Values: []string{"a"}}},
+		"invalid header":   {"cloudfront": {Header: "X-Origin: Secret", Values: []string{"a"}}},
+		"no values":        {"cloudfront": {Header: "X-Origin-Secret"}},
+		"empty value":      {"cloudfront": {Header: "X-Origin-Secret", Values: []string{"a", ""}}},
+	} {
+		if _, err := newOriginSecrets(m, nil); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+
+	cfg := CreateConfig()
+	cfg.Provider = "cloudfront"
+	cfg.AutoRefresh = false
+	cfg.OriginSecret["cloudfront"] = OriginSecret{Header: "X-Origin-Secret"}
+	if _, err := New(context.Background(), captureNext{}, cfg, "test"); err == nil {
+		t.Fatalf("expected New to refuse an originSecret without values")
+	}
+}
@@ -0,0 +1,34 @@
+// Package akamai provides the Akamai provider. Akamai does not publish an
+// unauthenticated edge list, so its ranges must be supplied via config
+// (e.g. the CIDRs of a SiteShield map).
+package akamai
+
+import "github.com/l4rm4nd/traefik-warp/providers"
+
+const Name providers.Provider = "akamai"
+
+const ClientIPHeaderName = "True-Client-IP"
+const OriginHopHeaderName = "Akamai-Origin-Hop"
+
+func init() {
+	providers.Register(source{})
+}
+
+type source struct{}
+
+func (source) Name() providers.Provider { return Name }
+
+// URLs is empty: there are no built-in ranges, so Akamai stays untrusted until configured.
+func (source) URLs() []string { return nil }
+
+func (source) Parse(body []byte) ([]string, error) {
+	return providers.ParseLines(body)
+}
+
+func (source) ClientIPHeader() string   { return ClientIPHeaderName }
+func (source) ProtoHeader() string      { return "" }
+func (source) Scheme(raw string) string { return "" }
+
+func (source) StripHeaders() []string {
+	return []string{ClientIPHeaderName, OriginHopHeaderName}
+}
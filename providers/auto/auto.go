@@ -1,14 +1,15 @@
+// Package auto registers every built-in provider. Import it (blank) to make
+// them available to the registry; new provider packages are added here.
 package auto
 
 import (
-	"github.com/l4rm4nd/traefik-warp/providers/cloudflare"
-	"github.com/l4rm4nd/traefik-warp/providers/cloudfront"
+	_ "github.com/l4rm4nd/traefik-warp/providers/akamai"
+	_ "github.com/l4rm4nd/traefik-warp/providers/azurefrontdoor"
+	_ "github.com/l4rm4nd/traefik-warp/providers/bunny"
+	_ "github.com/l4rm4nd/traefik-warp/providers/cloudflare"
+	_ "github.com/l4rm4nd/traefik-warp/providers/cloudfront"
+	_ "github.com/l4rm4nd/traefik-warp/providers/fastly"
+	_ "github.com/l4rm4nd/traefik-warp/providers/gcp"
+	_ "github.com/l4rm4nd/traefik-warp/providers/imperva"
+	_ "github.com/l4rm4nd/traefik-warp/providers/sucuri"
 )
-
-// TrustedIPS returns the union of Cloudflare and CloudFront trusted ranges.
-func TrustedIPS() []string {
-	var merged []string
-	merged = append(merged, cloudflare.TrustedIPS()...)
-	merged = append(merged, cloudfront.TrustedIPS()...)
-	return merged
-}
@@ -0,0 +1,87 @@
+// Package azurefrontdoor provides the Azure Front Door provider. Its backend
+// ranges are shared by all Azure customers, so requests are only trusted when
+// they also carry one of the configured Front Door profile IDs.
+package azurefrontdoor
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+const Name providers.Provider = "azurefrontdoor"
+
+const ClientIPHeaderName = "X-Azure-ClientIP"
+const SocketIPHeaderName = "X-Azure-SocketIP"
+const FDIDHeaderName = "X-Azure-FDID"
+const ForwardedProtoHeaderName = "X-Forwarded-Proto"
+
+// ServiceTag is the ServiceTags entry holding the Front Door backend ranges.
+const ServiceTag = "AzureFrontDoor.Backend"
+
+func init() {
+	providers.Register(source{})
+}
+
+type source struct{}
+
+func (source) Name() providers.Provider { return Name }
+
+// URLs is empty: Microsoft publishes the ServiceTags JSON under a weekly changing
+// file name, so its location must be configured via `rangesUrl`.
+// Found at https://www.microsoft.com/en-us/download/details.aspx?id=56519
+func (source) URLs() []string { return nil }
+
+// Parse extracts the AzureFrontDoor.Backend prefixes from a ServiceTags document.
+func (source) Parse(body []byte) ([]string, error) {
+	var data struct {
+		Values []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+	for _, v := range data.Values {
+		if v.Name == ServiceTag {
+			return v.Properties.AddressPrefixes, nil
+		}
+	}
+	return nil, errors.New("service tag " + ServiceTag + " is missing in the response")
+}
+
+func (source) ClientIPHeader() string { return ClientIPHeaderName }
+
+// ForwardedForDepth: Front Door appends the client socket IP to X-Forwarded-For.
+func (source) ForwardedForDepth() int { return 1 }
+
+func (source) ProtoHeader() string { return ForwardedProtoHeaderName }
+func (source) Scheme(raw string) string {
+	return providers.PlainScheme(raw)
+}
+
+func (source) StripHeaders() []string {
+	return []string{ClientIPHeaderName, SocketIPHeaderName, FDIDHeaderName}
+}
+
+// Verify requires X-Azure-FDID to match one of the configured profile IDs.
+func (source) Verify(h http.Header, ids []string) bool {
+	fdid := strings.TrimSpace(h.Get(FDIDHeaderName))
+	if fdid == "" {
+		return false
+	}
+	for _, id := range ids {
+		if strings.EqualFold(fdid, strings.TrimSpace(id)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (source) NeedsEdgeID() bool { return true }
@@ -0,0 +1,71 @@
+// Package bunny contains the current Bunny CDN edge server IPs
+package bunny
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+const Name providers.Provider = "bunny"
+
+const ClientIPHeaderName = "X-Real-IP"
+const CDNLoopHeaderName = "CDN-Loop"
+
+// cdnLoopTag is the CDN-Loop token Bunny adds to every request it forwards.
+const cdnLoopTag = "bunnycdn"
+
+func init() {
+	providers.Register(source{})
+}
+
+type source struct{}
+
+func (source) Name() providers.Provider { return Name }
+
+// URLs returns Bunny's edge server lists (plain IPs, not CIDRs).
+// Found at https://docs.bunny.net/docs/edge-server-ip-list
+func (source) URLs() []string {
+	return []string{
+		"https://api.bunny.net/system/edgeserverlist",
+		"https://api.bunny.net/system/edgeserverlist/ipv6",
+	}
+}
+
+// Parse reads a JSON array of IPs, falling back to one IP per line.
+func (source) Parse(body []byte) ([]string, error) {
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var ipList []string
+		if err := json.Unmarshal(trimmed, &ipList); err != nil {
+			return nil, err
+		}
+		return ipList, nil
+	}
+	return providers.ParseLines(body)
+}
+
+func (source) ClientIPHeader() string { return ClientIPHeaderName }
+
+// ForwardedForDepth: Bunny appends the visitor to X-Forwarded-For when X-Real-IP is absent.
+func (source) ForwardedForDepth() int { return 1 }
+
+func (source) ProtoHeader() string      { return "" }
+func (source) Scheme(raw string) string { return "" }
+
+// StripHeaders is empty: X-Real-IP and X-Forwarded-For are always cleaned.
+func (source) StripHeaders() []string { return nil }
+
+// Verify requires the request to be tagged by Bunny in CDN-Loop.
+func (source) Verify(h http.Header, _ []string) bool {
+	for _, v := range h.Values(CDNLoopHeaderName) {
+		if strings.Contains(strings.ToLower(v), cdnLoopTag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (source) NeedsEdgeID() bool { return false }
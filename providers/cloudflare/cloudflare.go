@@ -2,52 +2,68 @@
 package cloudflare
 
 import (
-	"bufio"
-	"fmt"
-	"net/http"
+	"encoding/json"
+	"time"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
 )
 
-// TrustedIPS fetches Cloudflare's current IP ranges (IPv4 + IPv6).
-func TrustedIPS() []string {
-	urls := []string{
+const ClientIPHeaderName = "CF-Connecting-IP"
+const CfVisitor = "CF-Visitor"
+const XCfTrusted = "X-Is-Trusted"
+const TunnelIDHeader = "Cf-Warp-Tag-Id" // set by cloudflared to the tunnel ID
+
+// OriginPullCAURL serves the CA of Cloudflare's global Authenticated Origin Pulls certificate.
+const OriginPullCAURL = "https://developers.cloudflare.com/ssl/static/authenticated_origin_pull_ca.pem"
+
+//go:generate go run ../../internal/snapshotgen -provider cloudflare
+
+func init() {
+	providers.Register(source{})
+}
+
+type source struct{}
+
+func (source) Name() providers.Provider { return providers.Cloudflare }
+
+// URLs returns Cloudflare's official IP range endpoints (IPv4 + IPv6).
+func (source) URLs() []string {
+	return []string{
 		"https://www.cloudflare.com/ips-v4",
 		"https://www.cloudflare.com/ips-v6",
 	}
+}
 
-	var ipList []string
-	for _, url := range urls {
-		resp, err := http.Get(url)
-		if err != nil {
-			fmt.Println("Error fetching", url, ":", err)
-			continue
-		}
-		defer resp.Body.Close()
-
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
-			ip := scanner.Text()
-			if ip != "" {
-				ipList = append(ipList, ip)
-			}
-		}
-
-		if err := scanner.Err(); err != nil {
-			fmt.Println("Error reading response from", url, ":", err)
-		}
-	}
+// Parse reads one CIDR per line.
+func (source) Parse(body []byte) ([]string, error) {
+	return providers.ParseLines(body)
+}
 
-	// Fallback: if nothing was fetched, allow all
-	if len(ipList) == 0 {
-		return []string{
-			"192.168.0.0/16",
-			"10.0.0.0/8",
-			"172.16.0.0/12",
-		}
-	}
+// BundledIPS returns the compiled-in snapshot (see snapshot.go), used when live fetches fail.
+func (source) BundledIPS() []string { return snapshot }
+func (source) BundledAt() time.Time { return snapshotAt }
 
-	return ipList
+// Limits reflects the ~20 ranges Cloudflare has published for years.
+func (source) Limits() providers.Limits {
+	l := providers.DefaultLimits()
+	l.MinCount, l.MaxCount = 10, 100
+	return l
 }
 
-const ClientIPHeaderName = "CF-Connecting-IP"
-const CfVisitor = "CF-Visitor"
-const XCfTrusted = "X-Is-Trusted"
+func (source) ClientIPHeader() string { return ClientIPHeaderName }
+func (source) ProtoHeader() string    { return CfVisitor }
+
+// Scheme extracts the scheme from a CF-Visitor JSON value, e.g. {"scheme":"https"}.
+func (source) Scheme(raw string) string {
+	var v struct {
+		Scheme string `json:"scheme"`
+	}
+	if json.Unmarshal([]byte(raw), &v) != nil {
+		return ""
+	}
+	return providers.PlainScheme(v.Scheme)
+}
+
+func (source) StripHeaders() []string {
+	return []string{ClientIPHeaderName, CfVisitor}
+}
@@ -1,71 +1,69 @@
-// Package ips contains a list of current cloud flare IP ranges
+// Package cloudfront contains a list of current AWS CloudFront IP ranges
 package cloudfront
 
 import (
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"net/http"
+	"errors"
+	"time"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
 )
 
-// CFIPs is the CloudFlare Server IP list (this is checked on build).
-func TrustedIPS() []string {
+const ClientIPHeaderName = "Cloudfront-Viewer-Address"
+const ForwardedProtoHeaderName = "Cloudfront-Forwarded-Proto"
 
-	// Found at https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/LocationsOfEdgeServers.html
-	url := "https://d7uri8nf7uskq.cloudfront.net/tools/list-cloudfront-ips"
+//go:generate go run ../../internal/snapshotgen -provider cloudfront
 
-	resp, err := http.Get(url)
-	if err != nil {
-		fmt.Println("Error making the request:", err)
-		return []string{
-			"192.168.0.0/16",
-			"10.0.0.0/8",
-			"172.16.0.0/12",
-		}
-	}
-	defer resp.Body.Close() // Ensure the response body is closed
+func init() {
+	providers.Register(source{})
+}
 
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading the response body:", err)
-		return []string{
-			"192.168.0.0/16",
-			"10.0.0.0/8",
-			"172.16.0.0/12",
-		}
-	}
+type source struct{}
+
+func (source) Name() providers.Provider { return providers.Cloudfront }
+
+// URLs returns the CloudFront edge list endpoint.
+// Found at https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/LocationsOfEdgeServers.html
+func (source) URLs() []string {
+	return []string{"https://d7uri8nf7uskq.cloudfront.net/tools/list-cloudfront-ips"}
+}
+
+// Parse merges the global and regional edge lists.
+func (source) Parse(body []byte) ([]string, error) {
 	// Define a map to hold the JSON data
 	var data map[string][]string
-
-	// Parse the JSON response
-	err = json.Unmarshal(body, &data)
-	if err != nil {
-		fmt.Println("Error parsing the JSON:", err)
-		return []string{
-			"192.168.0.0/16",
-			"10.0.0.0/8",
-			"172.16.0.0/12",
-		}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
 	}
 
 	// Extract the arrays
 	globalIPList, globalExists := data["CLOUDFRONT_GLOBAL_IP_LIST"]
 	regionalIPList, regionalExists := data["CLOUDFRONT_REGIONAL_EDGE_IP_LIST"]
-
 	if !globalExists && !regionalExists {
-		fmt.Println("Both keys are missing in the response")
-		return []string{
-			"192.168.0.0/16",
-			"10.0.0.0/8",
-			"172.16.0.0/12",
-		}
+		return nil, errors.New("both keys are missing in the response")
 	}
 
 	// Merge the arrays
-	mergedIPList := append(globalIPList, regionalIPList...)
+	return append(globalIPList, regionalIPList...), nil
+}
+
+// BundledIPS returns the compiled-in snapshot (see snapshot.go), used when live fetches fail.
+func (source) BundledIPS() []string { return snapshot }
+func (source) BundledAt() time.Time { return snapshotAt }
 
-	return mergedIPList
+// Limits reflects the ~200 global and regional edge ranges CloudFront publishes.
+func (source) Limits() providers.Limits {
+	l := providers.DefaultLimits()
+	l.MinCount, l.MaxCount = 50, 1000
+	return l
 }
 
-const ClientIPHeaderName = "Cloudfront-Viewer-Address"
+func (source) ClientIPHeader() string { return ClientIPHeaderName }
+func (source) ProtoHeader() string    { return ForwardedProtoHeaderName }
+func (source) Scheme(raw string) string {
+	return providers.PlainScheme(raw)
+}
+
+func (source) StripHeaders() []string {
+	return []string{ClientIPHeaderName}
+}
@@ -0,0 +1,169 @@
+// Package custom builds providers defined entirely in the middleware config,
+// for niche CDNs that have no built-in package.
+package custom
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+// List formats understood by Parse.
+const (
+	FormatLines     = "lines"      // one CIDR per line, # comments
+	FormatJSONArray = "json-array" // ["192.0.2.0/24", ...]
+	FormatJSON      = "json"       // JSON object, CIDRs selected via Spec.JSONKeys
+)
+
+// Spec defines a custom provider.
+type Spec struct {
+	Name           string
+	URLs           []string
+	Format         string
+	JSONKeys       []string // dotted paths, e.g. "addresses" or "prefixes.ipv4Prefix"; arrays are flattened
+	ClientIPHeader string
+	ProtoHeader    string
+	StripHeaders   []string
+}
+
+// Source is a providers.Source backed by a Spec. It is not added to the registry,
+// since custom providers are scoped to the middleware that defines them.
+type Source struct {
+	spec Spec
+	keys [][]string
+}
+
+// New validates spec and returns its source.
+func New(spec Spec) (*Source, error) {
+	spec.Name = strings.ToLower(strings.TrimSpace(spec.Name))
+	if spec.Name == "" {
+		return nil, errors.New("custom provider needs a name")
+	}
+	if !validName(spec.Name) {
+		return nil, fmt.Errorf("custom provider name %q may only contain a-z, 0-9, _ and -", spec.Name)
+	}
+	p := providers.Provider(spec.Name)
+	if p == providers.Auto || p == providers.Unknown {
+		return nil, fmt.Errorf("custom provider name %q is reserved", spec.Name)
+	}
+	if _, ok := providers.Lookup(p); ok {
+		return nil, fmt.Errorf("custom provider %q clashes with a built-in provider", spec.Name)
+	}
+	if strings.TrimSpace(spec.ClientIPHeader) == "" {
+		return nil, fmt.Errorf("custom provider %q needs a clientIpHeader", spec.Name)
+	}
+
+	s := &Source{spec: spec}
+	switch spec.Format {
+	case "", FormatLines, FormatJSONArray:
+	case FormatJSON:
+		if len(spec.JSONKeys) == 0 {
+			return nil, fmt.Errorf("custom provider %q: format %q needs jsonKeys", spec.Name, FormatJSON)
+		}
+		for _, k := range spec.JSONKeys {
+			s.keys = append(s.keys, splitKey(k))
+		}
+	default:
+		return nil, fmt.Errorf("custom provider %q: unknown format %q", spec.Name, spec.Format)
+	}
+	return s, nil
+}
+
+// validName reports whether name is safe to use in cache file names, logs and headers.
+func validName(name string) bool {
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseKey identifies how s parses its lists, so lists of custom providers with
+// the same name and URLs but a different format are not shared.
+func (s *Source) ParseKey() string {
+	return s.spec.Format + "|" + strings.Join(s.spec.JSONKeys, ",")
+}
+
+func (s *Source) Name() providers.Provider { return providers.Provider(s.spec.Name) }
+func (s *Source) URLs() []string           { return s.spec.URLs }
+
+func (s *Source) Parse(body []byte) ([]string, error) {
+	switch s.spec.Format {
+	case FormatJSONArray:
+		var ipList []string
+		if err := json.Unmarshal(bytes.TrimSpace(body), &ipList); err != nil {
+			return nil, err
+		}
+		return ipList, nil
+	case FormatJSON:
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return nil, err
+		}
+		var ipList []string
+		for _, path := range s.keys {
+			ipList = append(ipList, selectStrings(doc, path)...)
+		}
+		if len(ipList) == 0 {
+			return nil, errors.New("no jsonKeys matched in the response")
+		}
+		return ipList, nil
+	default:
+		return providers.ParseLines(body)
+	}
+}
+
+func (s *Source) ClientIPHeader() string { return s.spec.ClientIPHeader }
+func (s *Source) ProtoHeader() string    { return s.spec.ProtoHeader }
+func (s *Source) Scheme(raw string) string {
+	return providers.PlainScheme(raw)
+}
+
+// StripHeaders always includes the client IP and proto headers so they cannot be spoofed.
+func (s *Source) StripHeaders() []string {
+	headers := []string{s.spec.ClientIPHeader}
+	if s.spec.ProtoHeader != "" {
+		headers = append(headers, s.spec.ProtoHeader)
+	}
+	return append(headers, s.spec.StripHeaders...)
+}
+
+// splitKey turns a JSONPath-like key ("$.data.ranges[*]") into path segments.
+func splitKey(key string) []string {
+	key = strings.TrimPrefix(strings.TrimSpace(key), "$")
+	var path []string
+	for _, seg := range strings.Split(key, ".") {
+		seg = strings.TrimSuffix(strings.TrimSuffix(seg, "[*]"), "[]")
+		if seg != "" {
+			path = append(path, seg)
+		}
+	}
+	return path
+}
+
+// selectStrings walks path through v, flattening arrays on the way, and collects string leaves.
+func selectStrings(v interface{}, path []string) []string {
+	switch t := v.(type) {
+	case []interface{}:
+		var out []string
+		for _, e := range t {
+			out = append(out, selectStrings(e, path)...)
+		}
+		return out
+	case map[string]interface{}:
+		if len(path) == 0 {
+			return nil
+		}
+		return selectStrings(t[path[0]], path[1:])
+	case string:
+		if len(path) == 0 {
+			return []string{t}
+		}
+	}
+	return nil
+}
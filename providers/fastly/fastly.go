@@ -0,0 +1,50 @@
+// Package fastly contains the current Fastly IP ranges
+package fastly
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+const Name providers.Provider = "fastly"
+
+const ClientIPHeaderName = "Fastly-Client-IP"
+
+func init() {
+	providers.Register(source{})
+}
+
+type source struct{}
+
+func (source) Name() providers.Provider { return Name }
+
+// URLs returns Fastly's public IP list endpoint.
+// Found at https://www.fastly.com/documentation/reference/api/utils/public-ip-list/
+func (source) URLs() []string {
+	return []string{"https://api.fastly.com/public-ip-list"}
+}
+
+// Parse merges the IPv4 and IPv6 address lists.
+func (source) Parse(body []byte) ([]string, error) {
+	var data struct {
+		Addresses     []string `json:"addresses"`
+		IPv6Addresses []string `json:"ipv6_addresses"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+	if len(data.Addresses) == 0 && len(data.IPv6Addresses) == 0 {
+		return nil, errors.New("no addresses in the response")
+	}
+	return append(data.Addresses, data.IPv6Addresses...), nil
+}
+
+func (source) ClientIPHeader() string   { return ClientIPHeaderName }
+func (source) ProtoHeader() string      { return "" }
+func (source) Scheme(raw string) string { return "" }
+
+func (source) StripHeaders() []string {
+	return []string{ClientIPHeaderName}
+}
@@ -0,0 +1,211 @@
+package providers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultUserAgent      = "traefik-warp"
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultTimeout        = 30 * time.Second
+	MaxBodySize           = 16 << 20 // larger responses are refused
+)
+
+// FetcherOptions configures the HTTP client used for CIDR downloads.
+type FetcherOptions struct {
+	ConnectTimeout time.Duration // dial + TLS handshake
+	Timeout        time.Duration // whole request, including the body
+	Proxy          string        // HTTP(S) proxy URL; empty = proxy from environment
+	CAFile         string        // PEM bundle added to the system roots
+	UserAgent      string
+}
+
+// Fetcher downloads range lists for every provider. A nil *Fetcher uses the defaults.
+type Fetcher struct {
+	client    *http.Client
+	userAgent string
+
+	mu         sync.Mutex
+	validators map[string]*validator // by URL
+}
+
+// NewFetcher builds a Fetcher from opts, applying defaults for zero values.
+func NewFetcher(opts FetcherOptions) (*Fetcher, error) {
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = DefaultConnectTimeout
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = DefaultUserAgent
+	}
+
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: opts.ConnectTimeout}).DialContext,
+		TLSHandshakeTimeout:   opts.ConnectTimeout,
+		ResponseHeaderTimeout: opts.Timeout,
+		MaxIdleConns:          4,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	if opts.Proxy != "" {
+		u, err := url.Parse(opts.Proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q", opts.Proxy)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %q", opts.CAFile)
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &Fetcher{
+		client:     &http.Client{Transport: tr, Timeout: opts.Timeout},
+		userAgent:  opts.UserAgent,
+		validators: make(map[string]*validator),
+	}, nil
+}
+
+// ErrNotModified is returned by TrustedIPS when no endpoint changed since the last fetch.
+var ErrNotModified = errors.New("not modified")
+
+// validator remembers a response so the next request for its URL can be conditional.
+type validator struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+// Get downloads url, honoring ctx cancellation. Responses carrying ETag or
+// Last-Modified are remembered; the next Get sends a conditional request and a
+// 304 yields the remembered body with notModified set.
+func (f *Fetcher) Get(ctx context.Context, url string) (body []byte, notModified bool, err error) {
+	client, ua := &http.Client{Timeout: DefaultTimeout}, DefaultUserAgent
+	var prev *validator
+	if f != nil {
+		client, ua = f.client, f.userAgent
+		f.mu.Lock()
+		prev = f.validators[url]
+		f.mu.Unlock()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("User-Agent", ua)
+	// Some endpoints (e.g. Bunny) answer with XML unless JSON is requested.
+	req.Header.Set("Accept", "application/json, text/plain;q=0.9, */*;q=0.8")
+	if prev != nil {
+		if prev.etag != "" {
+			req.Header.Set("If-None-Match", prev.etag)
+		}
+		if prev.lastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.lastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && prev != nil {
+		return prev.body, true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, errors.New("unexpected status " + resp.Status)
+	}
+	body, err = io.ReadAll(io.LimitReader(resp.Body, MaxBodySize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(body) > MaxBodySize {
+		return nil, false, fmt.Errorf("response larger than %d bytes", MaxBodySize)
+	}
+
+	if f != nil {
+		v := &validator{etag: resp.Header.Get("ETag"), lastModified: resp.Header.Get("Last-Modified"), body: body}
+		f.mu.Lock()
+		if v.etag != "" || v.lastModified != "" {
+			f.validators[url] = v
+		} else {
+			delete(f.validators, url)
+		}
+		f.mu.Unlock()
+	}
+	return body, false, nil
+}
+
+// Forget drops the remembered responses of urls, so their next Get is unconditional.
+// Callers use it when a downloaded list is rejected, so a 304 cannot revive it.
+func (f *Fetcher) Forget(urls []string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, url := range urls {
+		delete(f.validators, url)
+	}
+}
+
+// TrustedIPS fetches and parses every endpoint in urls (usually s.URLs()) and returns the merged CIDRs.
+// Sources without endpoints yield their bundled ranges, or nothing (ranges supplied via config only).
+// A failure of any endpoint fails the whole list, so callers never swap in a partial list.
+// If every endpoint answered 304, ErrNotModified is returned and the caller keeps its list.
+func TrustedIPS(ctx context.Context, f *Fetcher, s Source, urls []string) ([]string, error) {
+	if len(urls) == 0 {
+		if b, ok := s.(Bundled); ok {
+			return b.BundledIPS(), nil
+		}
+		return nil, nil
+	}
+
+	var ipList []string
+	unchanged := true
+	for _, url := range urls {
+		body, notModified, err := f.Get(ctx, url)
+		if err != nil {
+			return nil, fmt.Errorf("fetch %s: %w", url, err)
+		}
+		unchanged = unchanged && notModified
+
+		cidrs, err := s.Parse(body)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", url, err)
+		}
+		ipList = append(ipList, cidrs...)
+	}
+	if unchanged {
+		return nil, ErrNotModified
+	}
+	if len(ipList) == 0 {
+		return nil, fmt.Errorf("no ranges in %v", urls)
+	}
+
+	return ipList, nil
+}
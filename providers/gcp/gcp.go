@@ -0,0 +1,82 @@
+// Package gcp contains the Google Front End proxy ranges used by Google Cloud CDN
+// and Cloud Load Balancing.
+package gcp
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+const Name providers.Provider = "gcp"
+
+const ForwardedProtoHeaderName = "X-Forwarded-Proto"
+
+func init() {
+	providers.Register(source{})
+}
+
+type source struct{}
+
+func (source) Name() providers.Provider { return Name }
+
+// URLs is empty: Google's published lists (goog.json, cloud.json) cover external IPs
+// any Google Cloud customer can obtain, so only the bundled GFE ranges are trusted
+// unless `rangesUrl` points elsewhere.
+func (source) URLs() []string { return nil }
+
+// BundledIPS returns the Google Front End ranges load balancer traffic comes from.
+// Found at https://cloud.google.com/load-balancing/docs/health-check-concepts#ip-ranges
+func (source) BundledIPS() []string {
+	return []string{
+		"130.211.0.0/22",
+		"35.191.0.0/16",
+	}
+}
+
+// BundledAt is when the bundled list was taken from the docs.
+func (source) BundledAt() time.Time { return time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC) }
+
+// Parse reads the goog.json / cloud.json format, for `rangesUrl` overrides:
+// {"prefixes": [{"ipv4Prefix": "..."}, {"ipv6Prefix": "..."}]}
+func (source) Parse(body []byte) ([]string, error) {
+	var data struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+		} `json:"prefixes"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+	var ipList []string
+	for _, p := range data.Prefixes {
+		if p.IPv4Prefix != "" {
+			ipList = append(ipList, p.IPv4Prefix)
+		}
+		if p.IPv6Prefix != "" {
+			ipList = append(ipList, p.IPv6Prefix)
+		}
+	}
+	if len(ipList) == 0 {
+		return nil, errors.New("no prefixes in the response")
+	}
+	return ipList, nil
+}
+
+// ClientIPHeader is empty: GCLB sends no dedicated client IP header.
+func (source) ClientIPHeader() string { return "" }
+
+// ForwardedForDepth: GCLB appends "<client>, <load balancer>" to X-Forwarded-For,
+// so the visitor is the last-but-one entry.
+func (source) ForwardedForDepth() int { return 2 }
+
+func (source) ProtoHeader() string { return ForwardedProtoHeaderName }
+func (source) Scheme(raw string) string {
+	return providers.PlainScheme(raw)
+}
+
+// StripHeaders is empty: X-Forwarded-* headers are always cleaned.
+func (source) StripHeaders() []string { return nil }
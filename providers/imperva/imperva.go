@@ -0,0 +1,73 @@
+// Package imperva contains the Imperva (Incapsula) WAF edge ranges
+package imperva
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+const Name providers.Provider = "imperva"
+
+const ClientIPHeaderName = "Incap-Client-IP"
+
+func init() {
+	providers.Register(source{})
+}
+
+type source struct{}
+
+func (source) Name() providers.Provider { return Name }
+
+// URLs is empty: Imperva's IP API requires a POST, so the bundled list is used
+// unless `rangesUrl` points to a copy of its response or a plain text list.
+func (source) URLs() []string { return nil }
+
+// BundledIPS returns Imperva's edge ranges.
+// Found at https://docs.imperva.com/bundle/z-kb-articles-km/page/c85245b7.html
+func (source) BundledIPS() []string {
+	return []string{
+		"199.83.128.0/21",
+		"198.143.32.0/19",
+		"149.126.72.0/21",
+		"103.28.248.0/22",
+		"185.11.124.0/22",
+		"192.230.64.0/18",
+		"45.64.64.0/22",
+		"107.154.0.0/16",
+		"45.60.0.0/16",
+		"45.223.0.0/16",
+		"131.125.128.0/17",
+		"2a02:e980::/29",
+	}
+}
+
+// BundledAt is unknown: the bundled list was not dated when it was taken
+// from the docs.
+func (source) BundledAt() time.Time { return time.Time{} }
+
+// Parse reads the IP API response ({"ipRanges": [...], "ipv6Ranges": [...]}),
+// falling back to one CIDR per line.
+func (source) Parse(body []byte) ([]string, error) {
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		var data struct {
+			IPRanges   []string `json:"ipRanges"`
+			IPv6Ranges []string `json:"ipv6Ranges"`
+		}
+		if err := json.Unmarshal(trimmed, &data); err != nil {
+			return nil, err
+		}
+		return append(data.IPRanges, data.IPv6Ranges...), nil
+	}
+	return providers.ParseLines(body)
+}
+
+func (source) ClientIPHeader() string   { return ClientIPHeaderName }
+func (source) ProtoHeader() string      { return "" }
+func (source) Scheme(raw string) string { return "" }
+
+func (source) StripHeaders() []string {
+	return []string{ClientIPHeaderName}
+}
@@ -0,0 +1,137 @@
+package providers
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Limits bounds what a fetched range list may look like before it is accepted,
+// so an HTML error page, a captive portal or a poisoned feed never becomes the allowlist.
+type Limits struct {
+	MinCount     int  // fewer entries looks truncated
+	MaxCount     int  // more entries looks bogus
+	MaxShrinkPct int  // maximum shrink vs. the previous list, in percent (100 = unchecked)
+	MinPrefixV4  int  // shorter IPv4 prefixes are too broad
+	MinPrefixV6  int  // shorter IPv6 prefixes are too broad
+	AllowPrivate bool // accept private/internal space (never sensible for public feeds)
+}
+
+// DefaultLimits applies to every source that does not implement Limited.
+func DefaultLimits() Limits {
+	return Limits{
+		MinCount:     1,
+		MaxCount:     10000,
+		MaxShrinkPct: 50,
+		MinPrefixV4:  8,
+		MinPrefixV6:  16,
+	}
+}
+
+// Limited is implemented by sources with tighter expectations than DefaultLimits.
+type Limited interface {
+	Limits() Limits
+}
+
+// LimitsFor returns the limits of s.
+func LimitsFor(s Source) Limits {
+	if l, ok := s.(Limited); ok {
+		return l.Limits()
+	}
+	return DefaultLimits()
+}
+
+// internalNets are never expected in a public edge list: trusting them would
+// trust sockets inside our own network, or addresses that are not routable at all.
+var internalNets = mustParsePrefixes(
+	"0.0.0.0/8",       // "this" network
+	"10.0.0.0/8",      // RFC1918
+	"100.64.0.0/10",   // CGNAT
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link-local
+	"172.16.0.0/12",   // RFC1918
+	"192.0.2.0/24",    // documentation (TEST-NET-1)
+	"192.168.0.0/16",  // RFC1918
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation (TEST-NET-2)
+	"203.0.113.0/24",  // documentation (TEST-NET-3)
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved
+	"::/128",          // unspecified
+	"::1/128",         // loopback
+	"2001:db8::/32",   // documentation
+	"fc00::/7",        // unique local
+	"fe80::/10",       // link-local
+	"ff00::/8",        // multicast
+)
+
+// Check validates cidrs against l. prev is the currently accepted list (may be empty).
+// Entries are judged as ParsePrefix returns them, i.e. as they will be trusted.
+func (l Limits) Check(cidrs, prev []string) error {
+	if len(cidrs) < l.MinCount {
+		return fmt.Errorf("only %d ranges, expected at least %d", len(cidrs), l.MinCount)
+	}
+	if l.MaxCount > 0 && len(cidrs) > l.MaxCount {
+		return fmt.Errorf("%d ranges, expected at most %d", len(cidrs), l.MaxCount)
+	}
+	if len(prev) > 0 && l.MaxShrinkPct < 100 {
+		if shrink := (len(prev) - len(cidrs)) * 100 / len(prev); shrink > l.MaxShrinkPct {
+			return fmt.Errorf("list shrank by %d%% (%d -> %d), more than %d%%", shrink, len(prev), len(cidrs), l.MaxShrinkPct)
+		}
+	}
+
+	for _, c := range cidrs {
+		p, err := ParsePrefix(strings.TrimSpace(c))
+		if err != nil {
+			return fmt.Errorf("invalid entry %q", c)
+		}
+		if p.Addr().Is4() && p.Bits() < l.MinPrefixV4 {
+			return fmt.Errorf("%s is broader than /%d", p, l.MinPrefixV4)
+		}
+		if p.Addr().Is6() && p.Bits() < l.MinPrefixV6 {
+			return fmt.Errorf("%s is broader than /%d", p, l.MinPrefixV6)
+		}
+		if !l.AllowPrivate {
+			for _, in := range internalNets {
+				if in.Overlaps(p) {
+					return fmt.Errorf("%s overlaps internal range %s", p, in)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ParsePrefix parses a CIDR, accepting bare (optionally bracketed) IPs as /32 (IPv4) or
+// /128 (IPv6) host routes. Host bits are masked, zones dropped and IPv4-mapped IPv6
+// prefixes folded into their IPv4 form, so they match (unmapped) socket addresses.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if a := p.Addr(); a.Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(a.Unmap(), p.Bits()-96)
+		}
+		return p.Masked(), nil
+	}
+	raw := strings.TrimSpace(s)
+	if strings.HasPrefix(raw, "[") && strings.HasSuffix(raw, "]") {
+		raw = raw[1 : len(raw)-1]
+	}
+	a, err := netip.ParseAddr(raw)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR or IP %q", s)
+	}
+	a = a.WithZone("").Unmap()
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+func mustParsePrefixes(cidrs ...string) []netip.Prefix {
+	out := make([]netip.Prefix, 0, len(cidrs))
+	for _, c := range cidrs {
+		out = append(out, netip.MustParsePrefix(c))
+	}
+	return out
+}
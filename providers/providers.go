@@ -15,27 +15,19 @@ const (
 	Cloudflare Provider = "cloudflare"
 )
 
-var List = map[Provider]Provider{
-	Auto:       Auto,
-	Cloudfront: Cloudfront,
-	Cloudflare: Cloudflare,
-}
-
-var ListExisting = map[Provider]Provider{
-	Cloudfront: Cloudfront,
-	Cloudflare: Cloudflare,
-}
-
 func (p Provider) String() string {
-	if v, ok := List[p]; ok {
-		return string(v)
+	if p == Auto {
+		return string(p)
+	}
+	if _, ok := Lookup(p); ok {
+		return string(p)
 	}
 	return ""
 }
 
 func (p *Provider) Validate() error {
-	if _, ok := List[*p]; !ok {
-		return errors.New(fmt.Sprint("invalid value", *p))
+	if p.String() == "" {
+		return errors.New(fmt.Sprint("invalid value ", *p))
 	}
 	return nil
 }
@@ -0,0 +1,128 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source describes an edge network (CDN/WAF) whose ranges and headers warp can trust.
+// Each provider lives in its own package and registers itself from init().
+type Source interface {
+	// Name is the provider key used in `provider` and `trustip`.
+	Name() Provider
+	// URLs lists the official endpoints publishing the edge CIDRs (overridable via `rangesUrl`).
+	URLs() []string
+	// Parse turns one endpoint response body into CIDR strings.
+	Parse(body []byte) ([]string, error)
+	// ClientIPHeader is the header carrying the visitor IP.
+	ClientIPHeader() string
+	// ProtoHeader is the header carrying the visitor scheme hint ("" if none).
+	ProtoHeader() string
+	// Scheme normalizes a ProtoHeader value to "http"/"https" ("" if unusable).
+	Scheme(raw string) string
+	// StripHeaders lists headers removed from requests that are not trusted.
+	StripHeaders() []string
+}
+
+// ForwardedForSource is implemented by sources whose edge appends the visitor to
+// X-Forwarded-For instead of (or in addition to) sending ClientIPHeader.
+type ForwardedForSource interface {
+	// ForwardedForDepth is the visitor's position counted from the right (1 = last entry).
+	ForwardedForDepth() int
+}
+
+// Verifier is implemented by sources whose edge ranges are shared between customers,
+// so a socket match alone is not enough to trust their headers.
+type Verifier interface {
+	// Verify reports whether h proves the request came through our edge, given the
+	// provider's configured `edgeId` values.
+	Verify(h http.Header, ids []string) bool
+	// NeedsEdgeID reports whether Verify can only succeed with configured `edgeId` values.
+	NeedsEdgeID() bool
+}
+
+// Bundled is implemented by sources that ship a static copy of their ranges,
+// used when no endpoint is configured or none could be fetched.
+type Bundled interface {
+	BundledIPS() []string
+	// BundledAt is when the bundled ranges were taken, so their age can be reported.
+	BundledAt() time.Time
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   []Source
+)
+
+// Register adds a source to the registry. Registering the same name twice panics.
+func Register(s Source) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, existing := range registry {
+		if existing.Name() == s.Name() {
+			panic("providers: duplicate source " + string(s.Name()))
+		}
+	}
+	registry = append(registry, s)
+}
+
+// Lookup returns the registered source for p.
+func Lookup(p Provider) (Source, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for _, s := range registry {
+		if s.Name() == p {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// Sources returns all registered sources in registration order.
+func Sources() []Source {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	out := make([]Source, len(registry))
+	copy(out, registry)
+	return out
+}
+
+// Resolve returns the sources covered by p: every registered source for Auto, otherwise just p.
+func Resolve(p Provider) []Source {
+	if p == Auto {
+		return Sources()
+	}
+	if s, ok := Lookup(p); ok {
+		return []Source{s}
+	}
+	return nil
+}
+
+// PlainScheme normalizes a plain "http"/"https" header value.
+func PlainScheme(raw string) string {
+	s := strings.ToLower(strings.TrimSpace(raw))
+	if s == "http" || s == "https" {
+		return s
+	}
+	return ""
+}
+
+// ParseLines reads one CIDR per line, skipping blank lines and # comments.
+func ParseLines(body []byte) ([]string, error) {
+	var ipList []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if ip := strings.TrimSpace(line); ip != "" {
+			ipList = append(ipList, ip)
+		}
+	}
+	return ipList, scanner.Err()
+}
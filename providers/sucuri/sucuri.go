@@ -0,0 +1,53 @@
+// Package sucuri contains the Sucuri WAF edge ranges
+package sucuri
+
+import (
+	"time"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+const Name providers.Provider = "sucuri"
+
+const ClientIPHeaderName = "X-Sucuri-ClientIP"
+const CountryHeaderName = "X-Sucuri-Country"
+
+func init() {
+	providers.Register(source{})
+}
+
+type source struct{}
+
+func (source) Name() providers.Provider { return Name }
+
+// URLs is empty: Sucuri publishes its ranges in the docs only, so the bundled
+// list is used unless `rangesUrl` points to a plain text list.
+func (source) URLs() []string { return nil }
+
+// BundledIPS returns Sucuri's firewall ranges.
+// Found at https://docs.sucuri.net/website-firewall/sucuri-firewall-troubleshooting-guide/
+func (source) BundledIPS() []string {
+	return []string{
+		"192.88.134.0/23",
+		"185.93.228.0/22",
+		"66.248.200.0/22",
+		"208.109.0.0/22",
+		"2a02:fe80::/29",
+	}
+}
+
+// BundledAt is unknown: the bundled list was not dated when it was taken
+// from the docs.
+func (source) BundledAt() time.Time { return time.Time{} }
+
+func (source) Parse(body []byte) ([]string, error) {
+	return providers.ParseLines(body)
+}
+
+func (source) ClientIPHeader() string   { return ClientIPHeaderName }
+func (source) ProtoHeader() string      { return "" }
+func (source) Scheme(raw string) string { return "" }
+
+func (source) StripHeaders() []string {
+	return []string{ClientIPHeaderName, CountryHeaderName}
+}
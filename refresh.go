@@ -0,0 +1,322 @@
+package traefik_warp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+// Fallback policies applied when a provider's ranges cannot be fetched.
+const (
+	fallbackKeep    = "keep"    // keep the last-known-good list (default)
+	fallbackPrivate = "private" // switch to RFC1918 ranges (legacy behavior)
+	fallbackNone    = "none"    // trust no built-in ranges until the next successful fetch
+)
+
+// privateFallback is only used with fallbackPolicy "private".
+var privateFallback = []string{
+	"192.168.0.0/16",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+}
+
+// providerState tracks the built-in ranges of one provider across refreshes.
+type providerState struct {
+	cidrs     []string // last-known-good ranges
+	fetchedAt time.Time
+	lastErr   error
+	failures  int // consecutive failures
+}
+
+// load acquires the shared ranges of every source, fetching only those no other
+// middleware instance has loaded yet, and builds the allowlist. The shared ranges
+// are released when ctx is done.
+func (d *Disolver) load(ctx context.Context) error {
+	if d.entries == nil {
+		d.entries = make(map[providers.Provider]*rangeEntry)
+	}
+	var errs []string
+	for _, s := range d.sources {
+		e, err := sharedRanges.acquire(ctx, d, s)
+		d.entries[s.Name()] = e
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	// Only a complete d.entries may be seen by the refresh loops.
+	sharedRanges.subscribe(d)
+	go func() {
+		<-ctx.Done()
+		sharedRanges.release(d)
+	}()
+
+	if err := d.rebuild(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// rebuild merges the built-in ranges with user-supplied CIDRs, then swaps atomically.
+func (d *Disolver) rebuild() error {
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
+
+	// Build a fresh map
+	newMap := make(map[providers.Provider][]netip.Prefix)
+	var errs []string
+	add := func(p providers.Provider, cidrs []string) {
+		for _, v := range cidrs {
+			c := strings.TrimSpace(v)
+			if c == "" {
+				continue
+			}
+			n, err := parseCIDROrIP(c)
+			if err != nil {
+				continue
+			}
+			if n.Bits() == 0 && !d.allowAnyTrust {
+				// trustip is validated in New; this catches trustipFile edits.
+				errs = append(errs, fmt.Sprintf("%s: refusing catch-all %s (set allowAnyTrust to permit)", p, n))
+				continue
+			}
+			newMap[p] = append(newMap[p], n)
+		}
+	}
+
+	for _, s := range d.sources {
+		// Built-in ranges, then user-provided extras
+		add(s.Name(), d.entries[s.Name()].ranges())
+		add(s.Name(), d.userTrust[string(s.Name())])
+		for _, path := range d.userTrustFile[string(s.Name())] {
+			cidrs, err := readCIDRFile(path)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			add(s.Name(), cidrs)
+		}
+	}
+
+	// Carve out excluded prefixes
+	for p, excl := range d.exclude {
+		if len(newMap[p]) > 0 && len(excl) > 0 {
+			newMap[p] = subtractPrefixes(newMap[p], excl)
+		}
+	}
+
+	// Swap atomically, but only when something changed
+	changed := false
+	d.mu.RLock()
+	for _, s := range d.sources {
+		added, removed := diffNets(d.TrustIP[s.Name()], newMap[s.Name()])
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		changed = true
+		logInfo("warp: CIDRs changed", "provider", string(s.Name()),
+			"added", fmt.Sprintf("%d", len(added)), "removed", fmt.Sprintf("%d", len(removed)),
+			"total", fmt.Sprintf("%d", len(newMap[s.Name()])))
+		if len(added)+len(removed) <= 10 {
+			logInfo("warp: CIDR diff", "provider", string(s.Name()), "added", strings.Join(added, ","), "removed", strings.Join(removed, ","))
+		}
+	}
+	d.mu.RUnlock()
+	if changed {
+		d.mu.Lock()
+		d.TrustIP = newMap
+		d.mu.Unlock()
+		d.publish()
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// refresh fetches the ranges of e. On failure the failure is recorded and
+// the fallback policy decides what to use instead.
+func (e *rangeEntry) refresh(ctx context.Context) error {
+	e.refreshMu.Lock()
+	defer e.refreshMu.Unlock()
+
+	cidrs, err := e.fetch(ctx)
+	e.mu.Lock()
+	e.cidrs = cidrs
+	e.mu.Unlock()
+	return err
+}
+
+// fetch returns the ranges to use for e. Caller holds refreshMu.
+func (e *rangeEntry) fetch(ctx context.Context) ([]string, error) {
+	s, st, urls := e.source, &e.st, e.urls
+	if e.cacheDir != "" && len(urls) > 0 {
+		// Another instance (or a previous run) may have fetched recently.
+		c, err := readCache(e.cacheDir, s.Name(), urls)
+		if err == nil {
+			if cerr := e.limits.Check(c.CIDRs, nil); cerr != nil {
+				err = fmt.Errorf("cached list rejected: %w", cerr)
+			}
+		}
+		if err == nil && c.FetchedAt.After(st.fetchedAt) {
+			st.cidrs, st.fetchedAt = c.CIDRs, c.FetchedAt
+		} else if err != nil && !os.IsNotExist(err) {
+			logWarn("warp: ignoring CIDR cache", "provider", string(s.Name()), "error", err.Error())
+		}
+		if st.cidrs != nil && time.Since(st.fetchedAt) < e.refreshInterval {
+			logInfo("warp: using cached CIDRs", "provider", string(s.Name()), "age", time.Since(st.fetchedAt).Round(time.Second).String())
+			// A fresh list ends any backoff, even when another instance fetched it.
+			st.lastErr, st.failures = nil, 0
+			return st.cidrs, nil
+		}
+	}
+
+	cidrs, err := providers.TrustedIPS(ctx, e.fetcher, s, urls)
+	if errors.Is(err, providers.ErrNotModified) && st.cidrs != nil {
+		cidrs, err = st.cidrs, nil
+	} else if err == nil && len(urls) > 0 {
+		// Truncated, oversized or poisoned lists count as failures.
+		if cerr := e.limits.Check(cidrs, st.cidrs); cerr != nil {
+			err = fmt.Errorf("rejected range list: %w", cerr)
+			// Otherwise the next refresh gets a 304 for the rejected list and counts it as success.
+			e.fetcher.Forget(urls)
+		}
+	}
+	if err == nil {
+		st.cidrs, st.fetchedAt, st.lastErr, st.failures = cidrs, time.Now(), nil, 0
+		if e.cacheDir != "" && len(urls) > 0 {
+			c := &cacheEntry{Provider: string(s.Name()), URLs: urls, FetchedAt: st.fetchedAt, CIDRs: cidrs}
+			if err := writeCache(e.cacheDir, c); err != nil {
+				logWarn("warp: writing CIDR cache failed", "provider", string(s.Name()), "error", err.Error())
+			}
+		}
+		return cidrs, nil
+	}
+
+	st.lastErr = err
+	st.failures++
+	err = fmt.Errorf("%s: %w", s.Name(), err)
+
+	switch e.fallbackPolicy {
+	case fallbackPrivate:
+		logWarn("warp: CIDR fetch failed, using private ranges", "provider", string(s.Name()), "failures", fmt.Sprintf("%d", st.failures))
+		return privateFallback, err
+	case fallbackNone:
+		logWarn("warp: CIDR fetch failed, trusting no built-in ranges", "provider", string(s.Name()), "failures", fmt.Sprintf("%d", st.failures))
+		return nil, err
+	}
+
+	if st.cidrs != nil {
+		logWarn("warp: CIDR fetch failed, keeping last-known-good ranges", "provider", string(s.Name()),
+			"failures", fmt.Sprintf("%d", st.failures), "age", time.Since(st.fetchedAt).Round(time.Second).String())
+		return st.cidrs, err
+	}
+	if b, ok := s.(providers.Bundled); ok && len(b.BundledIPS()) > 0 {
+		logWarn("warp: CIDR fetch failed, using bundled snapshot", "provider", string(s.Name()),
+			"snapshot", snapshotDate(b.BundledAt()), "age", snapshotAge(b.BundledAt()))
+		return b.BundledIPS(), err
+	}
+	logWarn("warp: CIDR fetch failed, no ranges known yet", "provider", string(s.Name()))
+	return nil, err
+}
+
+// diffNets returns the prefixes only in next (added) and only in prev (removed).
+func diffNets(prev, next []netip.Prefix) (added, removed []string) {
+	seen := make(map[netip.Prefix]bool, len(prev))
+	for _, n := range prev {
+		seen[n] = true
+	}
+	inNext := make(map[netip.Prefix]bool, len(next))
+	for _, n := range next {
+		if !seen[n] && !inNext[n] {
+			added = append(added, n.String())
+		}
+		inNext[n] = true
+	}
+	for n := range seen {
+		if !inNext[n] {
+			removed = append(removed, n.String())
+		}
+	}
+	sort.Strings(removed)
+	return added, removed
+}
+
+// subtractPrefixes returns the address space of prefixes minus excl, as prefixes.
+// Prefixes partially covered by an exclusion are split into the uncovered parts.
+func subtractPrefixes(prefixes, excl []netip.Prefix) []netip.Prefix {
+	out := prefixes
+	for _, e := range excl {
+		var next []netip.Prefix
+		for _, p := range out {
+			next = append(next, subtractPrefix(p, e)...)
+		}
+		out = next
+	}
+	return out
+}
+
+// subtractPrefix returns p minus e.
+func subtractPrefix(p, e netip.Prefix) []netip.Prefix {
+	if !p.Overlaps(e) {
+		return []netip.Prefix{p}
+	}
+	if e.Bits() <= p.Bits() {
+		return nil // e covers p
+	}
+	// Halve p until it equals e, keeping the halves that do not contain e.
+	var out []netip.Prefix
+	for p.Bits() < e.Bits() {
+		lo := netip.PrefixFrom(p.Addr(), p.Bits()+1)
+		b := p.Addr().AsSlice()
+		b[p.Bits()/8] |= 1 << (7 - uint(p.Bits()%8))
+		hiAddr, _ := netip.AddrFromSlice(b)
+		hi := netip.PrefixFrom(hiAddr, p.Bits()+1)
+		if lo.Contains(e.Addr()) {
+			out, p = append(out, hi), lo
+		} else {
+			out, p = append(out, lo), hi
+		}
+	}
+	return out
+}
+
+// snapshotDate renders the date of a bundled snapshot, or "unknown" for undated ones.
+func snapshotDate(at time.Time) string {
+	if at.IsZero() {
+		return "unknown"
+	}
+	return at.Format("2006-01-02")
+}
+
+// snapshotAge renders the age of a bundled snapshot in days, e.g. "42d", or "unknown".
+func snapshotAge(at time.Time) string {
+	if at.IsZero() {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dd", int(time.Since(at).Hours()/24))
+}
+
+// parseCIDROrIP parses a CIDR or bare IP the way range lists are checked, see providers.ParsePrefix.
+func parseCIDROrIP(s string) (netip.Prefix, error) {
+	return providers.ParsePrefix(s)
+}
+
+// readCIDRFile loads a user-supplied CIDR file (one per line, # comments allowed).
+func readCIDRFile(path string) ([]string, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read trustipFile %q: %w", path, err)
+	}
+	return providers.ParseLines(body)
+}
@@ -0,0 +1,543 @@
+package traefik_warp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+// flakyFeed serves a CIDR list until failing is set, then answers 503.
+type flakyFeed struct {
+	failing int32
+	body    string
+}
+
+func (f *flakyFeed) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	if atomic.LoadInt32(&f.failing) == 1 {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte(f.body))
+}
+
+func newFeedDisolver(t *testing.T, url, policy string) *Disolver {
+	t.Helper()
+	s, err := customSources([]CustomProvider{{Name: "examplecdn", URLs: []string{url}, ClientIPHeader: "X-Client"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Disolver{
+		provider:       "examplecdn",
+		sources:        s,
+		TrustIP:        make(map[providers.Provider][]netip.Prefix),
+		fallbackPolicy: policy,
+		limits:         map[providers.Provider]providers.Limits{"examplecdn": feedLimits()},
+	}
+}
+
+// feedLimits are the default limits, except that the documentation ranges
+// served by test feeds are accepted.
+func feedLimits() providers.Limits {
+	l := providers.DefaultLimits()
+	l.AllowPrivate = true
+	return l
+}
+
+// loadRanges loads the ranges of d the way New does. Its shared ranges are
+// released when the test ends.
+func loadRanges(t *testing.T, d *Disolver) error {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return d.load(ctx)
+}
+
+// refreshRanges refreshes every range entry of d the way the refresh loop does.
+func refreshRanges(d *Disolver) error {
+	var errs []string
+	for _, s := range d.sources {
+		if err := sharedRanges.refresh(context.Background(), d.entries[s.Name()]); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func Test_RefreshFailure_FallbackPolicy(t *testing.T) {
+	tests := []struct {
+		policy     string
+		wantTrust  []string // sockets that must be trusted after the failed refresh
+		wantReject []string
+	}{
+		{policy: fallbackKeep, wantTrust: []string{"192.0.2.1"}, wantReject: []string{"10.0.0.1"}},
+		{policy: fallbackPrivate, wantTrust: []string{"10.0.0.1"}, wantReject: []string{"192.0.2.1"}},
+		{policy: fallbackNone, wantReject: []string{"192.0.2.1", "10.0.0.1"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			feed := &flakyFeed{body: "192.0.2.0/24\n"}
+			srv := httptest.NewServer(feed)
+			defer srv.Close()
+
+			d := newFeedDisolver(t, srv.URL, tc.policy)
+			if err := loadRanges(t, d); err != nil {
+				t.Fatalf("initial refresh: %v", err)
+			}
+
+			atomic.StoreInt32(&feed.failing, 1)
+			if err := refreshRanges(d); err == nil {
+				t.Fatalf("expected refresh error")
+			}
+			if st := d.entries["examplecdn"].st; st.failures != 1 || st.lastErr == nil {
+				t.Fatalf("failure not recorded: %+v", st)
+			}
+
+			for _, ip := range tc.wantTrust {
+				if !d.trust(ip+":443", nil).trusted {
+					t.Fatalf("%s should be trusted", ip)
+				}
+			}
+			for _, ip := range tc.wantReject {
+				if d.trust(ip+":443", nil).trusted {
+					t.Fatalf("%s should not be trusted", ip)
+				}
+			}
+		})
+	}
+}
+
+func Test_RefreshFailure_AtStartup_TrustsNothing(t *testing.T) {
+	feed := &flakyFeed{failing: 1}
+	srv := httptest.NewServer(feed)
+	defer srv.Close()
+
+	d := newFeedDisolver(t, srv.URL, fallbackKeep)
+	if err := loadRanges(t, d); err == nil {
+		t.Fatalf("expected refresh error")
+	}
+	if n := len(d.TrustIP["examplecdn"]); n != 0 {
+		t.Fatalf("expected no ranges, got %d", n)
+	}
+}
+
+func Test_RefreshFailure_UsesBundledSnapshot(t *testing.T) {
+	feed := &flakyFeed{failing: 1}
+	srv := httptest.NewServer(feed)
+	defer srv.Close()
+
+	d := &Disolver{
+		provider:       providers.Cloudflare,
+		sources:        providers.Resolve(providers.Cloudflare),
+		TrustIP:        make(map[providers.Provider][]netip.Prefix),
+		rangesURL:      map[string][]string{"cloudflare": {srv.URL}}, // stand-in for an unreachable endpoint
+		fallbackPolicy: fallbackKeep,
+	}
+	if err := loadRanges(t, d); err == nil {
+		t.Fatalf("expected refresh error")
+	}
+	if res := d.trust("104.16.0.1:443", nil); !res.trusted || res.source.Name() != providers.Cloudflare {
+		t.Fatalf("snapshot range not trusted: %+v", res)
+	}
+}
+
+func Test_Refresh_ConditionalFetch(t *testing.T) {
+	var full, conditional int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&full, 1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	defer srv.Close()
+
+	f, err := newFetcher(FetchConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newFeedDisolver(t, srv.URL, fallbackKeep)
+	d.fetcher = f
+
+	if err := loadRanges(t, d); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for i := 1; i < 3; i++ {
+		if err := refreshRanges(d); err != nil {
+			t.Fatalf("refresh %d: %v", i, err)
+		}
+	}
+	if full != 1 || conditional != 2 {
+		t.Fatalf("want 1 full + 2 conditional fetches, got %d + %d", full, conditional)
+	}
+	if !d.trust("192.0.2.1:443", nil).trusted {
+		t.Fatalf("range lost after 304")
+	}
+}
+
+func Test_Refresh_SwapsOnlyOnChange(t *testing.T) {
+	feed := &flakyFeed{body: "192.0.2.0/24\n"}
+	srv := httptest.NewServer(feed)
+	defer srv.Close()
+
+	d := newFeedDisolver(t, srv.URL, fallbackKeep)
+	if err := loadRanges(t, d); err != nil {
+		t.Fatal(err)
+	}
+	before := d.TrustIP
+
+	if err := refreshRanges(d); err != nil {
+		t.Fatal(err)
+	}
+	if reflect.ValueOf(d.TrustIP).Pointer() != reflect.ValueOf(before).Pointer() {
+		t.Fatalf("unchanged refresh must not swap the allowlist")
+	}
+
+	feed.body = "192.0.2.0/24\n198.51.100.0/24\n"
+	if err := refreshRanges(d); err != nil {
+		t.Fatal(err)
+	}
+	if !d.trust("198.51.100.1:443", nil).trusted {
+		t.Fatalf("changed list not swapped in")
+	}
+}
+
+func Test_DiffNets(t *testing.T) {
+	parse := func(cidrs ...string) []netip.Prefix {
+		var out []netip.Prefix
+		for _, c := range cidrs {
+			n := netip.MustParsePrefix(c)
+			out = append(out, n)
+		}
+		return out
+	}
+	added, removed := diffNets(
+		parse("192.0.2.0/24", "198.51.100.0/24", "2001:db8::/32"),
+		parse("192.0.2.0/24", "203.0.113.0/24", "2001:db8::/32"),
+	)
+	if len(added) != 1 || added[0] != "203.0.113.0/24" {
+		t.Fatalf("added=%v", added)
+	}
+	if len(removed) != 1 || removed[0] != "198.51.100.0/24" {
+		t.Fatalf("removed=%v", removed)
+	}
+}
+
+func Test_Limits_Check(t *testing.T) {
+	l := providers.DefaultLimits()
+	l.MaxCount = 3
+	prev := []string{"1.0.0.0/24", "8.8.8.0/24", "9.9.9.0/24"}
+
+	tests := []struct {
+		name    string
+		cidrs   []string
+		limits  providers.Limits
+		wantErr bool
+	}{
+		{name: "ok", cidrs: []string{"1.0.0.0/24", "8.8.8.8", "2606:4700::/32"}, limits: l},
+		{name: "empty", cidrs: nil, limits: l, wantErr: true},
+		{name: "oversized", cidrs: []string{"192.0.2.0/25", "192.0.2.128/25", "198.51.100.0/24", "203.0.113.0/24"}, limits: l, wantErr: true},
+		{name: "html page", cidrs: []string{"<html>"}, limits: l, wantErr: true},
+		{name: "broad v4", cidrs: []string{"64.0.0.0/2"}, limits: l, wantErr: true},
+		{name: "broad v6", cidrs: []string{"2000::/3"}, limits: l, wantErr: true},
+		{name: "private", cidrs: []string{"10.1.0.0/16"}, limits: l, wantErr: true},
+		{name: "covers loopback", cidrs: []string{"127.0.0.0/8"}, limits: l, wantErr: true},
+		{name: "ula", cidrs: []string{"fd00::/8"}, limits: l, wantErr: true},
+		{name: "private allowed", cidrs: []string{"10.1.0.0/16"}, limits: providers.Limits{MinCount: 1, AllowPrivate: true}},
+		{name: "documentation", cidrs: []string{"198.51.100.0/24"}, limits: l, wantErr: true},
+		{name: "documentation v6", cidrs: []string{"2001:db8:1::/48"}, limits: l, wantErr: true},
+		{name: "benchmarking", cidrs: []string{"198.18.0.0/16"}, limits: l, wantErr: true},
+		{name: "mapped v4 judged as v4", cidrs: []string{"::ffff:64.0.0.0/99"}, limits: l, wantErr: true},
+		{name: "mapped v4 below minimum", cidrs: []string{"::ffff:1.0.0.0/103"}, limits: l, wantErr: true},
+		{name: "mapped v4 host route", cidrs: []string{"::ffff:1.1.1.1/128"}, limits: l},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.limits.Check(tc.cidrs, nil); (err != nil) != tc.wantErr {
+				t.Fatalf("Check(%v) err=%v, wantErr=%v", tc.cidrs, err, tc.wantErr)
+			}
+		})
+	}
+
+	t.Run("shrink", func(t *testing.T) {
+		if err := l.Check(prev[:1], prev); err == nil {
+			t.Fatalf("shrinking 3 -> 1 should be rejected")
+		}
+		if err := l.Check(prev[:2], prev); err != nil {
+			t.Fatalf("shrinking 3 -> 2 should pass: %v", err)
+		}
+		l.MaxShrinkPct = 100
+		if err := l.Check(prev[:1], prev); err != nil {
+			t.Fatalf("shrink check disabled: %v", err)
+		}
+	})
+}
+
+func Test_Refresh_RejectedListKeepsLastKnownGood(t *testing.T) {
+	feed := &flakyFeed{body: "192.0.2.0/24\n198.51.100.0/24\n203.0.113.0/24\n"}
+	srv := httptest.NewServer(feed)
+	defer srv.Close()
+
+	d := newFeedDisolver(t, srv.URL, fallbackKeep)
+	if err := loadRanges(t, d); err != nil {
+		t.Fatalf("initial refresh: %v", err)
+	}
+
+	for _, body := range []string{
+		"192.0.2.0/24\n",                        // truncated
+		"192.0.2.0/24\n10.0.0.0/8\n0.0.0.0/0\n", // poisoned
+	} {
+		feed.body = body
+		if err := refreshRanges(d); err == nil {
+			t.Fatalf("expected %q to be rejected", body)
+		}
+		if !d.trust("203.0.113.1:443", nil).trusted {
+			t.Fatalf("last-known-good range lost after rejecting %q", body)
+		}
+		if d.trust("10.0.0.1:443", nil).trusted {
+			t.Fatalf("rejected range trusted")
+		}
+	}
+}
+
+func Test_Refresh_RejectedListNotRevivedBy304(t *testing.T) {
+	var body atomic.Value
+	body.Store("192.0.2.0/24\n198.51.100.0/24\n203.0.113.0/24\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := body.Load().(string)
+		etag := fmt.Sprintf(`"%d"`, len(b))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(b))
+	}))
+	defer srv.Close()
+
+	f, err := newFetcher(FetchConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newFeedDisolver(t, srv.URL, fallbackKeep)
+	d.fetcher = f
+	if err := loadRanges(t, d); err != nil {
+		t.Fatalf("initial refresh: %v", err)
+	}
+
+	body.Store("192.0.2.0/24\n") // truncated, then served unchanged
+	for i := 1; i <= 2; i++ {
+		if err := refreshRanges(d); err == nil {
+			t.Fatalf("refresh %d: rejected list accepted", i)
+		}
+		if st := d.entries["examplecdn"].st; st.failures != i {
+			t.Fatalf("refresh %d: failures=%d", i, st.failures)
+		}
+	}
+}
+
+func Test_ProviderMapKeys_Validated(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Limits = map[string]Limits{"cloudfare": {MinCount: 5}}
+	cfg.RangesURL = map[string][]string{"cloudfrnt": {"https://example.test/ips"}}
+	cfg.EdgeID = map[string][]string{"azure": {"id"}}
+	err := validateTrustIP(cfg, nil)
+	for _, want := range []string{`limits: unknown provider "cloudfare"`, `rangesUrl: unknown provider "cloudfrnt"`, `edgeId: unknown provider "azure"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("want %q, got %v", want, err)
+		}
+	}
+}
+
+func Test_ResolveLimits(t *testing.T) {
+	sources := providers.Resolve(providers.Cloudflare)
+	got, err := resolveLimits(sources, map[string]Limits{"cloudflare": {MinCount: 5, MaxShrinkPercent: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := got[providers.Cloudflare]
+	if l.MinCount != 5 || l.MaxShrinkPct != 100 || l.MaxCount != providers.LimitsFor(sources[0]).MaxCount {
+		t.Fatalf("overrides not merged: %+v", l)
+	}
+
+	for _, bad := range []Limits{{MinCount: -1}, {MinPrefixV4: 33}, {MaxShrinkPercent: 101}, {MinCount: 500}} {
+		if _, err := resolveLimits(sources, map[string]Limits{"cloudflare": bad}); err == nil {
+			t.Fatalf("expected error for %+v", bad)
+		}
+	}
+}
+
+func Test_NextDelay_ExponentialBackoff(t *testing.T) {
+	e := &rangeEntry{source: providers.Resolve(providers.Cloudflare)[0], refreshInterval: time.Hour, retryMin: time.Second, retryMax: 10 * time.Second}
+	for failures, want := range map[int]time.Duration{
+		0:  time.Hour,
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  8 * time.Second,
+		5:  10 * time.Second,
+		64: 10 * time.Second,
+	} {
+		e.st.failures = failures
+		if got := e.nextDelay(); got != want {
+			t.Fatalf("failures=%d: got %s, want %s", failures, got, want)
+		}
+	}
+}
+
+func Test_Refresh_RetriesUntilSuccess(t *testing.T) {
+	feed := &countingFeed{flakyFeed: flakyFeed{failing: 1, body: "192.0.2.0/24\n"}}
+	srv := httptest.NewServer(feed)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := newFeedConfig(srv.URL)
+	cfg.RefreshInterval, cfg.RetryMin, cfg.RetryMax = "1h", "10ms", "40ms"
+	h, err := New(ctx, http.NotFoundHandler(), cfg, "warp-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := h.(*Disolver)
+
+	// Keep failing for a few retries, then recover.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&feed.hits) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no retries after failed refresh (hits=%d)", atomic.LoadInt32(&feed.hits))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	atomic.StoreInt32(&feed.failing, 0)
+	for !d.trust("192.0.2.1:443", nil).trusted {
+		if time.Now().After(deadline) {
+			t.Fatalf("range not loaded after recovery")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := d.entries["examplecdn"].nextDelay(); got != time.Hour {
+		t.Fatalf("expected normal interval after success, got %s", got)
+	}
+}
+
+func Test_RetryBackoff_Config(t *testing.T) {
+	min, max, err := retryBackoff("", "", time.Hour)
+	if err != nil || min != 30*time.Second || max != 30*time.Minute {
+		t.Fatalf("defaults: %s %s %v", min, max, err)
+	}
+	if min, max, _ = retryBackoff("2h", "3h", time.Hour); min != time.Hour || max != time.Hour {
+		t.Fatalf("bounds not capped at interval: %s %s", min, max)
+	}
+	for _, bad := range [][2]string{{"soon", ""}, {"", "-1m"}} {
+		if _, _, err := retryBackoff(bad[0], bad[1], time.Hour); err == nil {
+			t.Fatalf("expected error for %v", bad)
+		}
+	}
+}
+
+func Test_SubtractPrefixes(t *testing.T) {
+	parse := func(cidrs ...string) []netip.Prefix {
+		var out []netip.Prefix
+		for _, c := range cidrs {
+			out = append(out, netip.MustParsePrefix(c))
+		}
+		return out
+	}
+	tests := []struct {
+		name  string
+		from  []netip.Prefix
+		excl  []netip.Prefix
+		want  []string
+		probe map[string]bool // address -> still covered
+	}{
+		{name: "disjoint", from: parse("192.0.2.0/24"), excl: parse("198.51.100.0/24"), want: []string{"192.0.2.0/24"}},
+		{name: "covered", from: parse("192.0.2.0/25"), excl: parse("192.0.2.0/24"), want: nil},
+		{name: "split", from: parse("192.0.2.0/24"), excl: parse("192.0.2.64/26"),
+			want:  []string{"192.0.2.128/25", "192.0.2.0/26"},
+			probe: map[string]bool{"192.0.2.63": true, "192.0.2.64": false, "192.0.2.127": false, "192.0.2.128": true}},
+		{name: "host", from: parse("192.0.2.0/30"), excl: parse("192.0.2.1/32"),
+			want: []string{"192.0.2.2/31", "192.0.2.0/32"}},
+		{name: "v6", from: parse("2001:db8::/32"), excl: parse("2001:db8:8000::/33"), want: []string{"2001:db8::/33"}},
+		{name: "other family", from: parse("2001:db8::/32"), excl: parse("192.0.2.0/24"), want: []string{"2001:db8::/32"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := subtractPrefixes(tc.from, tc.excl)
+			var gotS []string
+			for _, p := range got {
+				gotS = append(gotS, p.String())
+			}
+			if !reflect.DeepEqual(gotS, tc.want) {
+				t.Fatalf("got %v, want %v", gotS, tc.want)
+			}
+			for ip, want := range tc.probe {
+				a := netip.MustParseAddr(ip)
+				covered := false
+				for _, p := range got {
+					covered = covered || p.Contains(a)
+				}
+				if covered != want {
+					t.Fatalf("%s covered=%v, want %v", ip, covered, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_Refresh_ExcludeIP(t *testing.T) {
+	feed := &flakyFeed{body: "192.0.2.0/24\n198.51.100.0/24\n"}
+	srv := httptest.NewServer(feed)
+	defer srv.Close()
+
+	d := newFeedDisolver(t, srv.URL, fallbackKeep)
+	d.userTrust = map[string][]string{"examplecdn": {"203.0.113.0/24"}}
+	d.exclude = map[providers.Provider][]netip.Prefix{
+		"examplecdn": {netip.MustParsePrefix("192.0.2.128/25"), netip.MustParsePrefix("203.0.113.7/32")},
+	}
+	if err := loadRanges(t, d); err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, want := range map[string]bool{
+		"192.0.2.1":    true,
+		"192.0.2.200":  false, // excluded from the feed
+		"198.51.100.1": true,
+		"203.0.113.6":  true,
+		"203.0.113.7":  false, // excluded from trustip
+	} {
+		if got := d.trust(ip+":443", nil).trusted; got != want {
+			t.Fatalf("%s trusted=%v, want %v", ip, got, want)
+		}
+	}
+
+	// 192.0.2.0/25 + 198.51.100.0/24 + 8 pieces of 203.0.113.0/24
+	if got, want := d.counts(), []string{"examplecdn", "10", "examplecdn.excluded", "2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("counts=%v, want %v", got, want)
+	}
+}
+
+func Test_ExcludeIP_Config(t *testing.T) {
+	if _, err := parseExcludes(map[string][]string{"cloudflare": {"192.0.2.0/33"}}); err == nil {
+		t.Fatalf("expected invalid excludeIp entry to fail")
+	}
+	cfg := CreateConfig()
+	cfg.ExcludeIP = map[string][]string{"cloudfare": {"192.0.2.0/24"}}
+	if err := validateTrustIP(cfg, nil); err == nil || !strings.Contains(err.Error(), `excludeIp: unknown provider "cloudfare"`) {
+		t.Fatalf("expected unknown excludeIp key to fail, got %v", err)
+	}
+}
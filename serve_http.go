@@ -2,15 +2,13 @@
 package traefik_warp
 
 import (
-	"encoding/json"
 	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"strings"
 
 	"github.com/l4rm4nd/traefik-warp/providers"
-	"github.com/l4rm4nd/traefik-warp/providers/cloudflare"
-	"github.com/l4rm4nd/traefik-warp/providers/cloudfront"
 )
 
 // cleanInboundForwardingHeaders removes spoofable forwarding headers.
@@ -34,17 +32,41 @@ func appendXFF(h http.Header, client string) {
 	}
 }
 
-// parseSocketIP extracts the remote IP from a net/http RemoteAddr string (ip:port or [ip]:port).
-func parseSocketIP(remoteAddr string) string {
+// parseAddr parses a bare or bracketed IP, dropping any IPv6 zone and
+// unmapping IPv4-mapped IPv6 addresses (::ffff:a.b.c.d -> a.b.c.d).
+func parseAddr(raw string) (netip.Addr, bool) {
+	raw = strings.TrimSpace(raw)
+	if strings.HasPrefix(raw, "[") && strings.HasSuffix(raw, "]") {
+		raw = raw[1 : len(raw)-1]
+	}
+	a, err := netip.ParseAddr(raw)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return a.WithZone("").Unmap(), true
+}
+
+// socketAddr parses a net/http RemoteAddr string (ip:port, [ip]:port or a raw IP).
+func socketAddr(remoteAddr string) (netip.Addr, bool) {
 	host, _, err := net.SplitHostPort(remoteAddr)
-	if err == nil && host != "" {
-		return host
+	if err != nil || host == "" {
+		// Fallback: if SplitHostPort failed (rare), try as raw IP.
+		host = remoteAddr
+	}
+	return parseAddr(host)
+}
+
+// parseSocketIP extracts the remote IP from a net/http RemoteAddr string (ip:port or [ip]:port),
+// normalized like parseAddr. Unparseable input is returned as is.
+func parseSocketIP(remoteAddr string) string {
+	if a, ok := socketAddr(remoteAddr); ok {
+		return a.String()
 	}
-	// Fallback: if SplitHostPort failed (rare), try as raw IP.
 	return remoteAddr
 }
 
 // extractClientIP tries to normalize a header value that might be "ip:port" or just "ip".
+// The result is normalized like parseAddr, or "" if raw holds no IP.
 func extractClientIP(raw string) string {
 	raw = strings.TrimSpace(raw)
 	if raw == "" {
@@ -53,26 +75,21 @@ func extractClientIP(raw string) string {
 
 	// First try standard host:port parsing (works for [v6]:port and v4:port).
 	if host, _, err := net.SplitHostPort(raw); err == nil && host != "" {
-		return host
-	}
-
-	// If it looks like a bracketed IPv6 without port.
-	if strings.HasPrefix(raw, "[") && strings.HasSuffix(raw, "]") {
-		return strings.TrimSuffix(strings.TrimPrefix(raw, "["), "]")
+		if a, ok := parseAddr(host); ok {
+			return a.String()
+		}
 	}
 
-	// If it's a bare IPv6 or IPv4, keep it if valid.
-	if ip := net.ParseIP(raw); ip != nil {
-		return raw
+	// Bare IPv6 or IPv4, possibly bracketed or zoned.
+	if a, ok := parseAddr(raw); ok {
+		return a.String()
 	}
 
 	// Defensive: if there's a trailing :NNN and removing it yields a valid IP, strip it.
 	if i := strings.LastIndexByte(raw, ':'); i > 0 {
-		hostPart := raw[:i]
-		portPart := raw[i+1:]
-		if _, err := strconv.Atoi(portPart); err == nil {
-			if ip := net.ParseIP(hostPart); ip != nil {
-				return hostPart
+		if _, err := strconv.Atoi(raw[i+1:]); err == nil {
+			if a, ok := parseAddr(raw[:i]); ok {
+				return a.String()
 			}
 		}
 	}
@@ -81,18 +98,51 @@ func extractClientIP(raw string) string {
 	return ""
 }
 
-// ipInProvider checks if ipStr is contained in a provider bucket (thread-safe).
-func (r *Disolver) ipInProvider(prov providers.Provider, ipStr string) bool {
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return false
+// forwardedForHops returns all X-Forwarded-For entries, leftmost first.
+func forwardedForHops(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values(xForwardFor) {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
 	}
-	// Use the locking helper added in disolver.go
-	return r.contains(prov, ip)
+	return hops
+}
+
+// forwardedForAt returns the X-Forwarded-For entry at depth (1 = rightmost), or "".
+func forwardedForAt(h http.Header, depth int) string {
+	hops := forwardedForHops(h)
+	if depth < 1 || depth > len(hops) {
+		return ""
+	}
+	return hops[len(hops)-depth]
+}
+
+// clientIPFor resolves the visitor IP using the matched source's extraction strategy:
+// its dedicated client IP header first, then its X-Forwarded-For position if it has one.
+// skip is the number of X-Forwarded-For entries appended behind the edge.
+func clientIPFor(src providers.Source, h http.Header, skip int) string {
+	if name := src.ClientIPHeader(); name != "" {
+		if ip := extractClientIP(h.Get(name)); ip != "" {
+			return ip
+		}
+	}
+	if x, ok := src.(providers.ForwardedForSource); ok {
+		if ip := extractClientIP(forwardedForAt(h, x.ForwardedForDepth()+skip)); ip != "" {
+			return ip
+		}
+	}
+	return ""
 }
 
 func (r *Disolver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	trustResult := r.trust(req.RemoteAddr, req)
+	remote, via := r.decision.resolve(req)
+	trustResult := r.trust(remote, req)
+	if trustResult.via != "" {
+		via = trustResult.via
+	}
 
 	if trustResult.isFatal {
 		http.Error(rw, "Unknown source", http.StatusInternalServerError)
@@ -102,86 +152,45 @@ func (r *Disolver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "Unknown source", http.StatusBadRequest)
 		return
 	}
+	if trustResult.reject {
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return
+	}
 	if trustResult.directIP == "" {
 		http.Error(rw, "Unknown source", http.StatusUnprocessableEntity)
 		return
 	}
 
-	// Always clear spoofable headers first.
-	cleanInboundForwardingHeaders(req.Header)
-
-	// Figure out which provider the *socket IP* matches, if any.
+	// The provider the *socket IP* matched, if any.
 	socketIP := parseSocketIP(req.RemoteAddr)
-	matched := providers.Unknown
-	if r.ipInProvider(providers.Cloudflare, socketIP) {
-		matched = providers.Cloudflare
-	} else if r.ipInProvider(providers.Cloudfront, socketIP) {
-		matched = providers.Cloudfront
-	}
+	src := trustResult.source
 
+	// Read the matched edge's hints before spoofable headers are cleared,
+	// since some edges (e.g. GCLB) use X-Forwarded-* themselves.
+	var clientIP, scheme string
 	if trustResult.trusted {
-		// Provider-agnostic trust markers
-		req.Header.Set(xWarpTrusted, "yes")
-		switch matched {
-		case providers.Cloudflare:
-			req.Header.Set(xWarpProvider, "cloudflare")
-		case providers.Cloudfront:
-			req.Header.Set(xWarpProvider, "cloudfront")
-		default:
-			req.Header.Set(xWarpProvider, "unknown")
-		}
-
-		// Provider-specific handling
-		switch r.provider {
-		case providers.Cloudflare, providers.Auto:
-			// Only consider CF-Visitor if the socket edge matched Cloudflare.
-			if matched == providers.Cloudflare {
-				if v := req.Header.Get(cloudflare.CfVisitor); v != "" {
-					var cfv CFVisitorHeader
-					if json.Unmarshal([]byte(v), &cfv) == nil {
-						s := strings.ToLower(strings.TrimSpace(cfv.Scheme))
-						if s == "http" || s == "https" {
-							req.Header.Set(xForwardProto, s)
-						}
-					}
-					// Drop raw CF-Visitor header to avoid leaking upstream.
-					req.Header.Del(cloudflare.CfVisitor)
-				}
+		clientIP = clientIPFor(src, req.Header, trustResult.hops)
+		if h := src.ProtoHeader(); h != "" {
+			if v := req.Header.Get(h); v != "" {
+				scheme = src.Scheme(v)
+				// Drop the raw header to avoid leaking upstream.
+				req.Header.Del(h)
 			}
-		case providers.Cloudfront:
-			// no-op here; we handle proto below
 		}
+	}
 
-		// If the edge is CloudFront, honor its proto hint if present (works for both Cloudfront and Auto).
-		if matched == providers.Cloudfront {
-			if p := strings.ToLower(strings.TrimSpace(req.Header.Get("Cloudfront-Forwarded-Proto"))); p == "http" || p == "https" {
-				req.Header.Set(xForwardProto, p)
-			}
-		}
+	// Always clear spoofable headers first; origin secrets never reach the backend.
+	cleanInboundForwardingHeaders(req.Header)
+	r.stripOriginSecrets(req.Header)
+	req.Header.Set(xWarpSource, via)
 
-		// Decide which header contains the client IP, binding to the matched provider in Auto.
-		var clientIPHeaderName string
-		switch r.provider {
-		case providers.Auto:
-			// Use the socket IP match to decide which header to trust
-			if matched == providers.Cloudflare && req.Header.Get(cloudflare.ClientIPHeaderName) != "" {
-				clientIPHeaderName = cloudflare.ClientIPHeaderName
-			} else if matched == providers.Cloudfront && req.Header.Get(cloudfront.ClientIPHeaderName) != "" {
-				clientIPHeaderName = cloudfront.ClientIPHeaderName
-			} else {
-				// no matching provider/header combo → will fall back to socket IP
-			}
-		default:
-			clientIPHeaderName = r.clientIPHeaderName
-		}
+	if trustResult.trusted {
+		// Provider-agnostic trust markers
+		req.Header.Set(xWarpTrusted, "yes")
+		req.Header.Set(xWarpProvider, string(src.Name()))
 
-		// Extract and validate client IP
-		var clientIP string
-		if clientIPHeaderName != "" {
-			clientIP = extractClientIP(req.Header.Get(clientIPHeaderName))
-			if net.ParseIP(clientIP) == nil {
-				clientIP = ""
-			}
+		if scheme != "" {
+			req.Header.Set(xForwardProto, scheme)
 		}
 		if clientIP == "" {
 			// Fallback to the direct socket IP (already parsed by r.trust()).
@@ -207,12 +216,10 @@ func (r *Disolver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		req.Header.Set(xWarpProvider, "unknown")
 
 		// Untrusted: strip provider-specific headers.
-		switch r.provider {
-		case providers.Cloudflare, providers.Auto:
-			req.Header.Del(cloudflare.CfVisitor)
-			req.Header.Del(cloudflare.ClientIPHeaderName)
-		case providers.Cloudfront:
-			req.Header.Del(cloudfront.ClientIPHeaderName)
+		for _, s := range r.sources {
+			for _, h := range s.StripHeaders() {
+				req.Header.Del(h)
+			}
 		}
 
 		// Use the direct socket IP.
@@ -226,7 +233,7 @@ func (r *Disolver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		// can fix setups where traefik is run behind a CDN and one want to use IPAllowList middlware
 		// example: https://community.traefik.io/t/ipwhitelist-with-excludedips-setting-will-result-in-empty-ip-address-when-there-is-1-ip-address-in-x-forwarded-for-header/17491
 		appendXFF(req.Header, useIP)
-		
+
 		req.Header.Set(xRealIP, useIP)
 
 		// Proto fallback
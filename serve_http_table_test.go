@@ -5,9 +5,12 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"testing"
 
 	"github.com/l4rm4nd/traefik-warp/providers"
+	"github.com/l4rm4nd/traefik-warp/providers/fastly"
+	"github.com/l4rm4nd/traefik-warp/providers/gcp"
 )
 
 type verboseNext struct{}
@@ -123,6 +126,104 @@ func Test_Scenarios_RealIPExtraction(t *testing.T) {
 			wantWarpTrusted: "yes",
 			wantWarpProv:    "cloudflare",
 		},
+		{
+			name:     "trusted fastly client ip",
+			provider: fastly.Name,
+			trustCIDRs: map[providers.Provider][]string{
+				fastly.Name: {"192.0.2.0/24"},
+			},
+			remoteAddr: "192.0.2.10:443",
+			headers: map[string]string{
+				"Fastly-Client-IP": "4.4.4.4",
+			},
+			wantIP:          "4.4.4.4",
+			wantWarpTrusted: "yes",
+			wantWarpProv:    "fastly",
+		},
+		{
+			name:     "auto picks fastly when socket in fastly and ignores CF header",
+			provider: providers.Auto,
+			trustCIDRs: map[providers.Provider][]string{
+				providers.Cloudflare: {"198.51.100.0/24"},
+				fastly.Name:          {"192.0.2.0/24"},
+			},
+			remoteAddr: "192.0.2.10:443",
+			headers: map[string]string{
+				"CF-Connecting-IP": "9.9.9.9", // should be ignored
+				"Fastly-Client-IP": "4.4.4.4",
+			},
+			wantIP:          "4.4.4.4",
+			wantWarpTrusted: "yes",
+			wantWarpProv:    "fastly",
+		},
+		{
+			name:     "gcp takes last-but-one X-Forwarded-For entry",
+			provider: gcp.Name,
+			trustCIDRs: map[providers.Provider][]string{
+				gcp.Name: {"130.211.0.0/22"},
+			},
+			remoteAddr: "130.211.0.5:443",
+			headers: map[string]string{
+				"X-Forwarded-For": "6.6.6.6, 3.3.3.3, 34.120.0.1", // spoofed, client, load balancer
+			},
+			wantIP:          "3.3.3.3",
+			wantWarpTrusted: "yes",
+			wantWarpProv:    "gcp",
+		},
+		{
+			name:     "gcp with short X-Forwarded-For falls back to socket ip",
+			provider: gcp.Name,
+			trustCIDRs: map[providers.Provider][]string{
+				gcp.Name: {"130.211.0.0/22"},
+			},
+			remoteAddr: "130.211.0.5:443",
+			headers: map[string]string{
+				"X-Forwarded-For": "34.120.0.1",
+			},
+			wantIP:          "130.211.0.5",
+			wantWarpTrusted: "yes",
+			wantWarpProv:    "gcp",
+		},
+		{
+			name:       "untrusted socket ignores X-Forwarded-For",
+			provider:   gcp.Name,
+			remoteAddr: "203.0.113.7:443",
+			headers: map[string]string{
+				"X-Forwarded-For": "3.3.3.3, 34.120.0.1",
+			},
+			wantIP:          "203.0.113.7",
+			wantWarpTrusted: "no",
+			wantWarpProv:    "unknown",
+		},
+		{
+			name:     "trusted sucuri client ip",
+			provider: providers.Auto,
+			trustCIDRs: map[providers.Provider][]string{
+				"sucuri": {"192.88.134.0/23"},
+			},
+			remoteAddr: "192.88.134.10:443",
+			headers: map[string]string{
+				"X-Sucuri-ClientIP": "5.5.5.5",
+				"Incap-Client-IP":   "9.9.9.9", // should be ignored
+			},
+			wantIP:          "5.5.5.5",
+			wantWarpTrusted: "yes",
+			wantWarpProv:    "sucuri",
+		},
+		{
+			name:     "trusted imperva client ip",
+			provider: "imperva",
+			trustCIDRs: map[providers.Provider][]string{
+				"imperva": {"45.60.0.0/16"},
+			},
+			remoteAddr: "45.60.1.2:443",
+			headers: map[string]string{
+				"Incap-Client-IP": "6.6.6.6",
+			},
+			wantIP:          "6.6.6.6",
+			wantWarpTrusted: "yes",
+			wantWarpProv:    "imperva",
+		},
 		{
 			name:     "malformed cloudfront header falls back to socket ip (still trusted)",
 			provider: providers.Cloudfront,
@@ -146,25 +247,21 @@ func Test_Scenarios_RealIPExtraction(t *testing.T) {
 				next:     verboseNext{},
 				name:     "test",
 				provider: tc.provider,
-				TrustIP:  make(map[providers.Provider][]*net.IPNet),
-			}
-			switch tc.provider {
-			case providers.Cloudflare:
-				d.clientIPHeaderName = "CF-Connecting-IP"
-			case providers.Cloudfront:
-				d.clientIPHeaderName = "Cloudfront-Viewer-Address"
+				sources:  providers.Resolve(tc.provider),
+				TrustIP:  make(map[providers.Provider][]netip.Prefix),
 			}
 
 			// Seed trust CIDRs
 			for p, cidrs := range tc.trustCIDRs {
 				for _, c := range cidrs {
-					_, n, err := net.ParseCIDR(c)
+					n, err := netip.ParsePrefix(c)
 					if err != nil {
 						t.Fatalf("bad test CIDR %q: %v", c, err)
 					}
 					d.TrustIP[p] = append(d.TrustIP[p], n)
 				}
 			}
+			d.publish()
 
 			// Build request
 			rr := httptest.NewRecorder()
@@ -2,9 +2,11 @@
 package traefik_warp
 
 import (
-	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/l4rm4nd/traefik-warp/providers"
@@ -23,10 +25,10 @@ func (captureNext) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+func mustCIDR(t *testing.T, cidr string) netip.Prefix {
 	t.Helper()
-	_, n, err := net.ParseCIDR(cidr)
-	if err != nil || n == nil {
+	n, err := netip.ParsePrefix(cidr)
+	if err != nil {
 		t.Fatalf("bad CIDR %q: %v", cidr, err)
 	}
 	return n
@@ -37,13 +39,8 @@ func newTestDisolver(provider providers.Provider) *Disolver {
 		next:     captureNext{},
 		name:     "test",
 		provider: provider,
-		TrustIP:  make(map[providers.Provider][]*net.IPNet),
-	}
-	switch provider {
-	case providers.Cloudflare:
-		d.clientIPHeaderName = "CF-Connecting-IP"
-	case providers.Cloudfront:
-		d.clientIPHeaderName = "Cloudfront-Viewer-Address"
+		sources:  providers.Resolve(provider),
+		TrustIP:  make(map[providers.Provider][]netip.Prefix),
 	}
 	return d
 }
@@ -80,6 +77,7 @@ func Test_Trusted_Cloudflare_HeaderPreferred(t *testing.T) {
 	d := newTestDisolver(providers.Cloudflare)
 	// Seed trust with a fake CF edge range and put socket IP inside it
 	d.TrustIP[providers.Cloudflare] = append(d.TrustIP[providers.Cloudflare], mustCIDR(t, "198.51.100.0/24"))
+	d.publish()
 
 	rr := httptest.NewRecorder()
 	req := httptest.NewRequest("GET", "http://example.test/", nil)
@@ -112,6 +110,7 @@ func Test_Trusted_Cloudflare_HeaderPreferred(t *testing.T) {
 func Test_Trusted_Cloudfront_HeaderPreferred(t *testing.T) {
 	d := newTestDisolver(providers.Cloudfront)
 	d.TrustIP[providers.Cloudfront] = append(d.TrustIP[providers.Cloudfront], mustCIDR(t, "203.0.113.0/24"))
+	d.publish()
 
 	rr := httptest.NewRecorder()
 	req := httptest.NewRequest("GET", "http://example.test/", nil)
@@ -143,6 +142,7 @@ func Test_Auto_BindsHeaderToMatchedProvider(t *testing.T) {
 	// Seed both buckets
 	d.TrustIP[providers.Cloudflare] = append(d.TrustIP[providers.Cloudflare], mustCIDR(t, "198.51.100.0/24"))
 	d.TrustIP[providers.Cloudfront] = append(d.TrustIP[providers.Cloudfront], mustCIDR(t, "203.0.113.0/24"))
+	d.publish()
 
 	rr := httptest.NewRecorder()
 	req := httptest.NewRequest("GET", "http://example.test/", nil)
@@ -171,6 +171,7 @@ func Test_Auto_BindsHeaderToMatchedProvider(t *testing.T) {
 func Test_CFVisitor_BadJSON_IsIgnored_NotFatal(t *testing.T) {
 	d := newTestDisolver(providers.Cloudflare)
 	d.TrustIP[providers.Cloudflare] = append(d.TrustIP[providers.Cloudflare], mustCIDR(t, "198.51.100.0/24"))
+	d.publish()
 
 	rr := httptest.NewRecorder()
 	req := httptest.NewRequest("GET", "http://example.test/", nil)
@@ -198,3 +199,399 @@ func Test_CFVisitor_BadJSON_IsIgnored_NotFatal(t *testing.T) {
 		t.Fatalf("X-Warp-Provider=%q", got)
 	}
 }
+
+func Test_GCP_ForwardedProtoHonored(t *testing.T) {
+	d := newTestDisolver(providers.Provider("gcp"))
+	d.TrustIP["gcp"] = append(d.TrustIP["gcp"], mustCIDR(t, "130.211.0.0/22"))
+	d.publish()
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://example.test/", nil)
+	req.RemoteAddr = "130.211.0.5:443"
+	req.Header.Set("X-Forwarded-For", "3.3.3.3, 34.120.0.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
+
+	d.ServeHTTP(rr, req)
+	if got := rr.Header().Get("Got-XRIP"); got != "3.3.3.3" {
+		t.Fatalf("X-Real-IP=%q", got)
+	}
+	// Inbound chain is replaced by the resolved client
+	if got := rr.Header().Get("Got-XFF"); got != "3.3.3.3" {
+		t.Fatalf("X-Forwarded-For=%q", got)
+	}
+	if got := rr.Header().Get("Got-XFP"); got != "https" {
+		t.Fatalf("X-Forwarded-Proto=%q", got)
+	}
+}
+
+func Test_AzureFrontDoor_RequiresMatchingFDID(t *testing.T) {
+	const fdid = "a3b4c5d6-0000-4000-8000-000000000001"
+	tests := []struct {
+		name        string
+		edgeIDs     []string
+		fdidHeader  string
+		wantIP      string
+		wantTrusted string
+	}{
+		{name: "matching FDID", edgeIDs: []string{fdid}, fdidHeader: fdid, wantIP: "8.8.8.8", wantTrusted: "yes"},
+		{name: "rotated FDID list", edgeIDs: []string{"other", fdid}, fdidHeader: fdid, wantIP: "8.8.8.8", wantTrusted: "yes"},
+		{name: "foreign FDID", edgeIDs: []string{fdid}, fdidHeader: "someone-else", wantIP: "147.243.0.10", wantTrusted: "no"},
+		{name: "missing FDID", edgeIDs: []string{fdid}, wantIP: "147.243.0.10", wantTrusted: "no"},
+		{name: "no edgeId configured", fdidHeader: fdid, wantIP: "147.243.0.10", wantTrusted: "no"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestDisolver(providers.Provider("azurefrontdoor"))
+			d.TrustIP["azurefrontdoor"] = append(d.TrustIP["azurefrontdoor"], mustCIDR(t, "147.243.0.0/16"))
+			d.publish()
+			d.edgeIDs = map[string][]string{"azurefrontdoor": tc.edgeIDs}
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://example.test/", nil)
+			req.RemoteAddr = "147.243.0.10:443"
+			req.Header.Set("X-Azure-ClientIP", "8.8.8.8")
+			if tc.fdidHeader != "" {
+				req.Header.Set("X-Azure-FDID", tc.fdidHeader)
+			}
+
+			d.ServeHTTP(rr, req)
+			if got := rr.Header().Get("Got-XRIP"); got != tc.wantIP {
+				t.Fatalf("X-Real-IP=%q", got)
+			}
+			if got := rr.Header().Get("Got-Warp-Trusted"); got != tc.wantTrusted {
+				t.Fatalf("X-Warp-Trusted=%q", got)
+			}
+		})
+	}
+}
+
+func Test_Auto_FallsThroughToNextMatchingSource(t *testing.T) {
+	const fdid = "a3b4c5d6-0000-4000-8000-000000000001"
+	tests := []struct {
+		name         string
+		fdidHeader   string
+		wantIP       string
+		wantProvider string
+	}{
+		{name: "front door vouches", fdidHeader: fdid, wantIP: "8.8.8.8", wantProvider: "azurefrontdoor"},
+		{name: "front door does not vouch, cloudflare covers the address", wantIP: "1.2.3.4", wantProvider: "cloudflare"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestDisolver(providers.Auto)
+			// Overlapping ranges; azurefrontdoor is registered before cloudflare.
+			d.TrustIP["azurefrontdoor"] = append(d.TrustIP["azurefrontdoor"], mustCIDR(t, "198.51.100.0/24"))
+			d.TrustIP[providers.Cloudflare] = append(d.TrustIP[providers.Cloudflare], mustCIDR(t, "198.51.100.0/24"))
+			d.publish()
+			d.edgeIDs = map[string][]string{"azurefrontdoor": {fdid}}
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://example.test/", nil)
+			req.RemoteAddr = "198.51.100.10:443"
+			req.Header.Set("X-Azure-ClientIP", "8.8.8.8")
+			req.Header.Set("CF-Connecting-IP", "1.2.3.4")
+			if tc.fdidHeader != "" {
+				req.Header.Set("X-Azure-FDID", tc.fdidHeader)
+			}
+
+			d.ServeHTTP(rr, req)
+			if got := rr.Header().Get("Got-XRIP"); got != tc.wantIP {
+				t.Fatalf("X-Real-IP=%q, want %q", got, tc.wantIP)
+			}
+			if got := rr.Header().Get("Got-Warp-Provider"); got != tc.wantProvider {
+				t.Fatalf("X-Warp-Provider=%q, want %q", got, tc.wantProvider)
+			}
+		})
+	}
+}
+
+func Test_Bunny_RequiresCDNLoopTag(t *testing.T) {
+	tests := []struct {
+		name        string
+		cdnLoop     string
+		wantIP      string
+		wantTrusted string
+	}{
+		{name: "tagged", cdnLoop: "BunnyCDN", wantIP: "4.4.4.4", wantTrusted: "yes"},
+		{name: "untagged", wantIP: "192.0.2.7", wantTrusted: "no"},
+		{name: "foreign tag", cdnLoop: "cloudflare", wantIP: "192.0.2.7", wantTrusted: "no"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestDisolver(providers.Provider("bunny"))
+			// Bunny publishes bare edge IPs
+			n, err := parseCIDROrIP("192.0.2.7")
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.TrustIP["bunny"] = append(d.TrustIP["bunny"], n)
+			d.publish()
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://example.test/", nil)
+			req.RemoteAddr = "192.0.2.7:443"
+			req.Header.Set("X-Real-IP", "4.4.4.4")
+			if tc.cdnLoop != "" {
+				req.Header.Set("CDN-Loop", tc.cdnLoop)
+			}
+
+			d.ServeHTTP(rr, req)
+			if got := rr.Header().Get("Got-XRIP"); got != tc.wantIP {
+				t.Fatalf("X-Real-IP=%q", got)
+			}
+			if got := rr.Header().Get("Got-Warp-Trusted"); got != tc.wantTrusted {
+				t.Fatalf("X-Warp-Trusted=%q", got)
+			}
+		})
+	}
+}
+
+func Test_Bunny_EdgeServerListTrusted(t *testing.T) {
+	// Bunny's feeds list bare edge IPs: a JSON array, or one address per line.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/edgeserverlist", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`["89.187.162.5","89.187.162.6"]`))
+	})
+	mux.HandleFunc("/edgeserverlist/ipv6", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("2400:52e0:1a00::1\n2400:52e0:1a00::2\n"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	d := newTestDisolver(providers.Provider("bunny"))
+	d.rangesURL = map[string][]string{"bunny": {srv.URL + "/edgeserverlist", srv.URL + "/edgeserverlist/ipv6"}}
+	if err := loadRanges(t, d); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	var got []string
+	for _, n := range d.TrustIP["bunny"] {
+		got = append(got, n.String())
+	}
+	want := []string{"89.187.162.5/32", "89.187.162.6/32", "2400:52e0:1a00::1/128", "2400:52e0:1a00::2/128"}
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	tests := []struct {
+		remote      string
+		wantTrusted string
+	}{
+		{remote: "89.187.162.5:443", wantTrusted: "yes"},
+		{remote: "[2400:52e0:1a00::2]:443", wantTrusted: "yes"},
+		{remote: "89.187.162.7:443", wantTrusted: "no"}, // host routes only
+		{remote: "[2400:52e0:1a00::3]:443", wantTrusted: "no"},
+	}
+	for _, tc := range tests {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://example.test/", nil)
+		req.RemoteAddr = tc.remote
+		req.Header.Set("X-Real-IP", "4.4.4.4")
+		req.Header.Set("CDN-Loop", "BunnyCDN")
+
+		d.ServeHTTP(rr, req)
+		if got := rr.Header().Get("Got-Warp-Trusted"); got != tc.wantTrusted {
+			t.Fatalf("%s: X-Warp-Trusted=%q", tc.remote, got)
+		}
+		if tc.wantTrusted == "yes" && rr.Header().Get("Got-XRIP") != "4.4.4.4" {
+			t.Fatalf("%s: X-Real-IP=%q", tc.remote, rr.Header().Get("Got-XRIP"))
+		}
+	}
+}
+
+func Test_Untrusted_StripsProviderHeaders(t *testing.T) {
+	d := newTestDisolver(providers.Auto)
+	custom, err := customSources([]CustomProvider{{Name: "examplecdn", ClientIPHeader: "X-Example-Client", ProtoHeader: "X-Example-Proto"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.sources = append(d.sources, custom...)
+
+	var got http.Header
+	d.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://example.test/", nil)
+	req.RemoteAddr = "203.0.113.7:54321" // not in any trust range
+	spoofed := []string{
+		"CF-Connecting-IP", "CF-Visitor", "Cloudfront-Viewer-Address", "Fastly-Client-IP",
+		"True-Client-IP", "X-Azure-ClientIP", "X-Sucuri-ClientIP", "Incap-Client-IP",
+		"X-Example-Client", "X-Example-Proto",
+	}
+	for _, h := range spoofed {
+		req.Header.Set(h, "1.2.3.4")
+	}
+
+	d.ServeHTTP(rr, req)
+	for _, h := range spoofed {
+		if v := got.Get(h); v != "" {
+			t.Fatalf("%s not stripped: %q", h, v)
+		}
+	}
+}
+
+func Test_AddressForms_Normalized(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string // socket
+		header     string // client IP header value
+		wantSocket string
+		wantClient string
+	}{
+		{name: "v4", remoteAddr: "104.16.0.1:443", header: "198.51.100.7", wantSocket: "104.16.0.1", wantClient: "198.51.100.7"},
+		{name: "v4 with port", remoteAddr: "104.16.0.1:443", header: "198.51.100.7:5555", wantSocket: "104.16.0.1", wantClient: "198.51.100.7"},
+		{name: "mapped socket", remoteAddr: "[::ffff:104.16.0.1]:443", header: "198.51.100.7", wantSocket: "104.16.0.1", wantClient: "198.51.100.7"},
+		{name: "mapped header", remoteAddr: "104.16.0.1:443", header: "::ffff:198.51.100.7", wantSocket: "104.16.0.1", wantClient: "198.51.100.7"},
+		{name: "mapped bracketed header", remoteAddr: "104.16.0.1:443", header: "[::ffff:198.51.100.7]:5555", wantSocket: "104.16.0.1", wantClient: "198.51.100.7"},
+		{name: "v6 bracketed", remoteAddr: "[2400:cb00::1]:443", header: "[2001:db8::7]", wantSocket: "2400:cb00::1", wantClient: "2001:db8::7"},
+		{name: "v6 bracketed with port", remoteAddr: "[2400:cb00::1]:443", header: "[2001:DB8::7]:5555", wantSocket: "2400:cb00::1", wantClient: "2001:db8::7"},
+		{name: "zoned header", remoteAddr: "104.16.0.1:443", header: "fe80::7%eth0", wantSocket: "104.16.0.1", wantClient: "fe80::7"},
+		{name: "zoned bracketed header", remoteAddr: "104.16.0.1:443", header: "[fe80::7%eth0]:5555", wantSocket: "104.16.0.1", wantClient: "fe80::7"},
+		{name: "garbage header", remoteAddr: "104.16.0.1:443", header: "not-an-ip", wantSocket: "104.16.0.1", wantClient: ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseSocketIP(tc.remoteAddr); got != tc.wantSocket {
+				t.Fatalf("parseSocketIP(%q)=%q, want %q", tc.remoteAddr, got, tc.wantSocket)
+			}
+			if got := extractClientIP(tc.header); got != tc.wantClient {
+				t.Fatalf("extractClientIP(%q)=%q, want %q", tc.header, got, tc.wantClient)
+			}
+
+			// End to end: the socket matches Cloudflare's v4/v6 ranges in any form.
+			d := newTestDisolver(providers.Cloudflare)
+			d.TrustIP[providers.Cloudflare] = append(d.TrustIP[providers.Cloudflare], mustCIDR(t, "104.16.0.0/13"), mustCIDR(t, "2400:cb00::/32"))
+			d.publish()
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://example.test/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set("CF-Connecting-IP", tc.header)
+			d.ServeHTTP(rr, req)
+
+			want := tc.wantClient
+			if want == "" {
+				want = tc.wantSocket
+			}
+			if got := rr.Header().Get("Got-Warp-Trusted"); got != "yes" {
+				t.Fatalf("socket %q not trusted", tc.remoteAddr)
+			}
+			if got := rr.Header().Get("Got-XRIP"); got != want {
+				t.Fatalf("X-Real-IP=%q, want %q", got, want)
+			}
+		})
+	}
+
+	// Zoned link-local sockets parse, but never match public ranges.
+	d := newTestDisolver(providers.Cloudflare)
+	if res := d.trust("[fe80::1%eth0]:443", nil); res.isError || res.trusted || res.directIP != "fe80::1" {
+		t.Fatalf("zoned socket: %+v", res)
+	}
+}
+
+func Test_IntermediateProxies_WalkForwardedFor(t *testing.T) {
+	tests := []struct {
+		name         string
+		provider     providers.Provider
+		remoteAddr   string
+		xff          string
+		headers      map[string]string
+		wantTrusted  string
+		wantProvider string
+		wantIP       string
+	}{
+		{
+			name: "cloudfront behind ALB", provider: providers.Auto,
+			remoteAddr: "10.0.0.5:443", xff: "4.4.4.4, 203.0.113.10",
+			headers:     map[string]string{"Cloudfront-Viewer-Address": "4.4.4.4:5555"},
+			wantTrusted: "yes", wantProvider: "cloudfront", wantIP: "4.4.4.4",
+		},
+		{
+			name: "two intermediate hops", provider: providers.Auto,
+			remoteAddr: "10.0.0.5:443", xff: "4.4.4.4, 203.0.113.10, 10.0.1.9",
+			headers:     map[string]string{"Cloudfront-Viewer-Address": "4.4.4.4:5555"},
+			wantTrusted: "yes", wantProvider: "cloudfront", wantIP: "4.4.4.4",
+		},
+		{
+			name: "gcp depth shifted by intermediate hop", provider: providers.Provider("gcp"),
+			remoteAddr: "10.0.0.5:443", xff: "3.3.3.3, 34.120.0.1, 130.211.0.5",
+			wantTrusted: "yes", wantProvider: "gcp", wantIP: "3.3.3.3",
+		},
+		{
+			name: "spoofed edge left of an untrusted hop", provider: providers.Auto,
+			remoteAddr: "10.0.0.5:443", xff: "203.0.113.10, 198.51.100.66",
+			headers:     map[string]string{"Cloudfront-Viewer-Address": "4.4.4.4:5555"},
+			wantTrusted: "no", wantProvider: "unknown", wantIP: "198.51.100.66",
+		},
+		{
+			name: "no forwarded hops", provider: providers.Auto,
+			remoteAddr:  "10.0.0.5:443",
+			wantTrusted: "no", wantProvider: "unknown", wantIP: "10.0.0.5",
+		},
+		{
+			name: "garbage hop", provider: providers.Auto,
+			remoteAddr: "10.0.0.5:443", xff: "203.0.113.10, not-an-ip",
+			wantTrusted: "no", wantProvider: "unknown", wantIP: "10.0.0.5",
+		},
+		{
+			name: "socket is not an intermediate", provider: providers.Auto,
+			remoteAddr: "192.0.2.50:443", xff: "4.4.4.4, 203.0.113.10",
+			headers:     map[string]string{"Cloudfront-Viewer-Address": "4.4.4.4:5555"},
+			wantTrusted: "no", wantProvider: "unknown", wantIP: "192.0.2.50",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestDisolver(tc.provider)
+			d.TrustIP[providers.Cloudfront] = append(d.TrustIP[providers.Cloudfront], mustCIDR(t, "203.0.113.0/24"))
+			d.TrustIP["gcp"] = append(d.TrustIP["gcp"], mustCIDR(t, "130.211.0.0/22"))
+			d.publish()
+			var err error
+			if d.intermediates, err = parsePrefixList("intermediateProxies", []string{"10.0.0.0/16"}, false); err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://example.test/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.xff != "" {
+				req.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			d.ServeHTTP(rr, req)
+
+			if got := rr.Header().Get("Got-Warp-Trusted"); got != tc.wantTrusted {
+				t.Fatalf("X-Warp-Trusted=%q, want %q", got, tc.wantTrusted)
+			}
+			if got := rr.Header().Get("Got-Warp-Provider"); got != tc.wantProvider {
+				t.Fatalf("X-Warp-Provider=%q, want %q", got, tc.wantProvider)
+			}
+			if got := rr.Header().Get("Got-XRIP"); got != tc.wantIP {
+				t.Fatalf("X-Real-IP=%q, want %q", got, tc.wantIP)
+			}
+		})
+	}
+}
+
+func Test_IntermediateProxies_Config(t *testing.T) {
+	if _, err := parsePrefixList("intermediateProxies", []string{"10.0.0.0/8", "nope"}, false); err == nil {
+		t.Fatalf("expected invalid entry to fail")
+	}
+	if _, err := parsePrefixList("intermediateProxies", []string{"0.0.0.0/0"}, false); err == nil {
+		t.Fatalf("expected catch-all to need allowAnyTrust")
+	}
+	if got, err := parsePrefixList("intermediateProxies", []string{"10.0.0.7", "::/0"}, true); err != nil || len(got) != 2 {
+		t.Fatalf("got %v, %v", got, err)
+	}
+}
@@ -0,0 +1,231 @@
+package traefik_warp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+	"github.com/l4rm4nd/traefik-warp/providers/custom"
+)
+
+// rangeStore shares the built-in ranges of each provider between all middleware
+// instances of the process: one fetch, one refresh timer and one list per provider,
+// however many middlewares (and routers) use it.
+type rangeStore struct {
+	mu      sync.Mutex
+	entries map[string]*rangeEntry
+}
+
+var sharedRanges = &rangeStore{entries: make(map[string]*rangeEntry)}
+
+// rangeEntry holds the built-in ranges of one provider. Instances only share an
+// entry when everything that influences the list (endpoints, list format, fetch settings,
+// limits, fallback, cache and refresh settings) is identical.
+type rangeEntry struct {
+	key             string
+	source          providers.Source
+	urls            []string
+	fetcher         *providers.Fetcher
+	limits          providers.Limits
+	fallbackPolicy  string
+	cacheDir        string        // on-disk CIDR cache, "" = disabled
+	refreshInterval time.Duration // cache entries younger than this are not re-fetched
+	retryMin        time.Duration
+	retryMax        time.Duration
+
+	refreshMu sync.Mutex    // serializes refresh
+	st        providerState // guarded by refreshMu
+
+	mu    sync.RWMutex // guards cidrs
+	cidrs []string     // ranges currently in effect (last-known-good or fallback)
+
+	ready chan struct{} // closed after the first refresh
+
+	// guarded by rangeStore.mu
+	refs int
+	subs map[*Disolver]bool
+	stop context.CancelFunc
+}
+
+// ranges returns the ranges currently in effect.
+func (e *rangeEntry) ranges() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.cidrs
+}
+
+// newEntry builds an entry for s from the settings of d.
+func (d *Disolver) newEntry(s providers.Source) *rangeEntry {
+	e := &rangeEntry{
+		source:          s,
+		urls:            d.urlsFor(s),
+		fetcher:         d.fetcher,
+		limits:          d.limitsFor(s),
+		fallbackPolicy:  d.fallbackPolicy,
+		cacheDir:        d.cacheDir,
+		refreshInterval: d.refreshInterval,
+		retryMin:        d.retryMin,
+		retryMax:        d.retryMax,
+		ready:           make(chan struct{}),
+		subs:            make(map[*Disolver]bool),
+	}
+	var parseKey string
+	if c, ok := s.(*custom.Source); ok {
+		parseKey = c.ParseKey()
+	}
+	e.key = fmt.Sprintf("%s|%s|%s|%s|%+v|%s|%s|%s|%s|%s|%t", s.Name(), parseKey, strings.Join(e.urls, ","), d.fetchKey,
+		e.limits, e.fallbackPolicy, e.cacheDir, e.refreshInterval, e.retryMin, e.retryMax, d.autoRefresh)
+	return e
+}
+
+// acquire takes a reference to the shared entry for s. The first user fetches
+// the ranges and, with autoRefresh, starts the refresh loop; later users wait for
+// that first fetch and reuse its result. d receives refresh rebuilds only once it
+// is subscribed, see subscribe.
+func (rs *rangeStore) acquire(ctx context.Context, d *Disolver, s providers.Source) (*rangeEntry, error) {
+	e := d.newEntry(s)
+
+	rs.mu.Lock()
+	shared, ok := rs.entries[e.key]
+	if ok {
+		e = shared
+	} else {
+		rs.entries[e.key] = e
+	}
+	e.refs++
+	rs.mu.Unlock()
+
+	if ok {
+		select {
+		case <-e.ready:
+			return e, nil
+		case <-ctx.Done():
+			return e, ctx.Err()
+		}
+	}
+
+	err := e.refresh(ctx)
+	close(e.ready)
+	if d.autoRefresh {
+		loopCtx, cancel := context.WithCancel(context.Background())
+		rs.mu.Lock()
+		if e.refs > 0 {
+			e.stop = cancel
+			go rs.loop(loopCtx, e)
+		} else {
+			cancel()
+		}
+		rs.mu.Unlock()
+	}
+	return e, err
+}
+
+// subscribe registers d with all of its entries, so refreshes rebuild its allowlist.
+// Call it once d.entries is complete: rebuild reads d.entries from the refresh loop.
+func (rs *rangeStore) subscribe(d *Disolver) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, e := range d.entries {
+		e.subs[d] = true
+	}
+}
+
+// release drops every entry reference held by d; entries without users stop refreshing.
+// Releasing d twice is a no-op.
+func (rs *rangeStore) release(d *Disolver) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, e := range d.entries {
+		if !e.subs[d] {
+			continue
+		}
+		delete(e.subs, d)
+		e.refs--
+		if e.refs > 0 {
+			continue
+		}
+		if e.stop != nil {
+			e.stop()
+		}
+		if rs.entries[e.key] == e {
+			delete(rs.entries, e.key)
+		}
+	}
+}
+
+// loop refreshes e periodically and rebuilds the allowlists of its users until ctx is done.
+// After a failed refresh it retries with exponential backoff until the next success.
+func (rs *rangeStore) loop(ctx context.Context, e *rangeEntry) {
+	delay := e.nextDelay()
+	if delay == e.refreshInterval {
+		delay += time.Duration(int64(time.Second) * (int64(time.Now().UnixNano()) % 7))
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			// Failures and changes are logged by refresh and rebuild.
+			_ = rs.refresh(ctx, e)
+			t.Reset(e.nextDelay())
+		}
+	}
+}
+
+// refresh re-fetches the ranges of e and rebuilds the allowlists of its users.
+func (rs *rangeStore) refresh(ctx context.Context, e *rangeEntry) error {
+	var errs []string
+	if err := e.refresh(ctx); err != nil {
+		logWarn("warp: periodic CIDR refresh failed", "error", err.Error())
+		errs = append(errs, err.Error())
+	}
+	for _, d := range rs.users(e) {
+		if err := d.rebuild(); err != nil {
+			logWarn("warp: periodic CIDR refresh failed", "error", err.Error(), "middleware", d.name)
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// nextDelay returns the refresh interval, or the backoff delay while refreshes fail:
+// retryMin doubled per consecutive failure, capped at retryMax.
+func (e *rangeEntry) nextDelay() time.Duration {
+	e.refreshMu.Lock()
+	failures := e.st.failures
+	e.refreshMu.Unlock()
+	if failures == 0 || e.retryMin <= 0 {
+		return e.refreshInterval
+	}
+
+	delay := e.retryMin
+	for i := 1; i < failures && delay < e.retryMax; i++ {
+		delay *= 2
+	}
+	if delay > e.retryMax {
+		delay = e.retryMax
+	}
+	logInfo("warp: CIDR refresh failed, retrying with backoff", "provider", string(e.source.Name()),
+		"failures", fmt.Sprintf("%d", failures), "retryIn", delay.String(), "retryMax", e.retryMax.String())
+	return delay
+}
+
+// users returns a snapshot of the instances using e.
+func (rs *rangeStore) users(e *rangeEntry) []*Disolver {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	out := make([]*Disolver, 0, len(e.subs))
+	for d := range e.subs {
+		out = append(out, d)
+	}
+	return out
+}
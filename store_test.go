@@ -0,0 +1,194 @@
+package traefik_warp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+func newFeedConfig(url string) *Config {
+	cfg := CreateConfig()
+	cfg.Provider = "examplecdn"
+	cfg.CustomProviders = []CustomProvider{{Name: "examplecdn", URLs: []string{url}, ClientIPHeader: "X-Client"}}
+	cfg.Limits["examplecdn"] = Limits{AllowPrivate: true} // test feeds serve documentation ranges
+	return cfg
+}
+
+func sharedEntryCount(key string) (n int, refs int) {
+	sharedRanges.mu.Lock()
+	defer sharedRanges.mu.Unlock()
+	for k, e := range sharedRanges.entries {
+		if k == key {
+			n++
+			refs = e.refs
+		}
+	}
+	return n, refs
+}
+
+func Test_SharedRanges_OneFetchForAllInstances(t *testing.T) {
+	feed := &countingFeed{flakyFeed: flakyFeed{body: "192.0.2.0/24\n"}}
+	srv := httptest.NewServer(feed)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var handlers []*Disolver
+	for _, name := range []string{"warp-a", "warp-b", "warp-c"} {
+		h, err := New(ctx, http.NotFoundHandler(), newFeedConfig(srv.URL), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handlers = append(handlers, h.(*Disolver))
+	}
+
+	if hits := atomic.LoadInt32(&feed.hits); hits != 1 {
+		t.Fatalf("expected a single fetch, got %d", hits)
+	}
+	e := handlers[0].entries["examplecdn"]
+	for _, d := range handlers {
+		if d.entries["examplecdn"] != e {
+			t.Fatalf("%s does not share the range entry", d.name)
+		}
+		if !d.trust("192.0.2.1:443", nil).trusted {
+			t.Fatalf("%s: shared range not trusted", d.name)
+		}
+	}
+	if n, refs := sharedEntryCount(e.key); n != 1 || refs != 3 {
+		t.Fatalf("want 1 entry with 3 refs, got %d entries, %d refs", n, refs)
+	}
+
+	// A refresh of the shared entry reaches every instance.
+	feed.body = "192.0.2.0/24\n198.51.100.0/24\n"
+	if err := sharedRanges.refresh(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range handlers {
+		if !d.trust("198.51.100.1:443", nil).trusted {
+			t.Fatalf("%s: refreshed range not trusted", d.name)
+		}
+	}
+
+	// Releasing the last user stops the timer and drops the entry.
+	cancel()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if n, _ := sharedEntryCount(e.key); n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("shared entry not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_SharedRanges_DifferentSettingsNotShared(t *testing.T) {
+	feed := &countingFeed{flakyFeed: flakyFeed{body: "192.0.2.0/24\n"}}
+	srv := httptest.NewServer(feed)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, err := New(ctx, http.NotFoundHandler(), newFeedConfig(srv.URL), "warp-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := newFeedConfig(srv.URL)
+	cfg.FallbackPolicy = fallbackNone
+	b, err := New(ctx, http.NotFoundHandler(), cfg, "warp-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.(*Disolver).entries["examplecdn"] == b.(*Disolver).entries["examplecdn"] {
+		t.Fatalf("instances with different fallbackPolicy must not share ranges")
+	}
+	if hits := atomic.LoadInt32(&feed.hits); hits != 2 {
+		t.Fatalf("expected one fetch per distinct setting, got %d", hits)
+	}
+}
+
+func Test_SharedRanges_DifferentFormatsNotShared(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"v4": ["192.0.2.0/24"], "v6": ["2001:db8::/32"]}`))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var handlers []*Disolver
+	for _, key := range []string{"v4", "v6"} {
+		cfg := newFeedConfig(srv.URL)
+		cfg.CustomProviders[0].Format = "json"
+		cfg.CustomProviders[0].JSONKeys = []string{key}
+		h, err := New(ctx, http.NotFoundHandler(), cfg, "warp-"+key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handlers = append(handlers, h.(*Disolver))
+	}
+
+	if handlers[0].entries["examplecdn"] == handlers[1].entries["examplecdn"] {
+		t.Fatalf("instances with different jsonKeys must not share ranges")
+	}
+	if !handlers[0].trust("192.0.2.1:443", nil).trusted || handlers[0].trust("[2001:db8::1]:443", nil).trusted {
+		t.Fatalf("warp-v4 must trust only the v4 list")
+	}
+	if !handlers[1].trust("[2001:db8::1]:443", nil).trusted || handlers[1].trust("192.0.2.1:443", nil).trusted {
+		t.Fatalf("warp-v6 must trust only the v6 list")
+	}
+}
+
+func Test_SharedRanges_RefreshDuringLoad(t *testing.T) {
+	// The failing feed keeps the shared refresh loop retrying every millisecond
+	// while the second instance is still loading its slow second provider.
+	feed := &flakyFeed{failing: 1}
+	srv := httptest.NewServer(feed)
+	defer srv.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("198.51.100.0/24\n"))
+	}))
+	defer slow.Close()
+
+	sources, err := customSources([]CustomProvider{
+		{Name: "examplecdn", URLs: []string{srv.URL}, ClientIPHeader: "X-Client"},
+		{Name: "othercdn", URLs: []string{slow.URL}, ClientIPHeader: "X-Client"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDisolver := func(sources []providers.Source) *Disolver {
+		return &Disolver{
+			sources:         sources,
+			TrustIP:         make(map[providers.Provider][]netip.Prefix),
+			fallbackPolicy:  fallbackKeep,
+			autoRefresh:     true,
+			refreshInterval: time.Hour,
+			retryMin:        time.Millisecond,
+			retryMax:        time.Millisecond,
+			limits:          map[providers.Provider]providers.Limits{"examplecdn": feedLimits(), "othercdn": feedLimits()},
+		}
+	}
+
+	a := newDisolver(sources[:1])
+	if err := loadRanges(t, a); err == nil {
+		t.Fatalf("expected the failing feed to fail")
+	}
+	b := newDisolver(sources)
+	_ = loadRanges(t, b) // examplecdn keeps failing
+	if b.entries["examplecdn"] != a.entries["examplecdn"] {
+		t.Fatalf("instances do not share the range entry")
+	}
+	if !b.trust("198.51.100.1:443", nil).trusted {
+		t.Fatalf("second provider not loaded")
+	}
+}
@@ -0,0 +1,102 @@
+package traefik_warp
+
+import (
+	"net/netip"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+// trieNode is a node of a binary prefix trie. A node with ranks set ends a prefix.
+type trieNode struct {
+	child [2]*trieNode
+	ranks []int // indexes into prefixTable.sources of the sources ending here, ascending
+}
+
+// prefixTable maps prefixes to sources with one binary trie per address family.
+// It is immutable once built, so lookups need no locking.
+type prefixTable struct {
+	sources []providers.Source // in rank order; lower ranks win on overlaps
+	v4      *trieNode
+	v6      *trieNode
+}
+
+// buildTable compiles the ranges of sources into a prefixTable.
+func buildTable(sources []providers.Source, nets map[providers.Provider][]netip.Prefix) *prefixTable {
+	t := &prefixTable{sources: sources, v4: &trieNode{}, v6: &trieNode{}}
+	for rank, s := range sources {
+		for _, n := range nets[s.Name()] {
+			t.insert(n, rank)
+		}
+	}
+	return t
+}
+
+func (t *prefixTable) insert(p netip.Prefix, rank int) {
+	if !p.IsValid() {
+		return
+	}
+	root := t.v6
+	if p.Addr().Is4() {
+		root = t.v4
+	}
+	ip := p.Addr().AsSlice()
+
+	node := root
+	for i := 0; i < p.Bits(); i++ {
+		b := ip[i/8] >> (7 - uint(i%8)) & 1
+		if node.child[b] == nil {
+			node.child[b] = &trieNode{}
+		}
+		node = node.child[b]
+	}
+	node.ranks = insertRank(node.ranks, rank)
+}
+
+// insertRank adds rank to the ascending list ranks unless it is already present.
+func insertRank(ranks []int, rank int) []int {
+	i := 0
+	for i < len(ranks) && ranks[i] < rank {
+		i++
+	}
+	if i < len(ranks) && ranks[i] == rank {
+		return ranks
+	}
+	ranks = append(ranks, 0)
+	copy(ranks[i+1:], ranks[i:])
+	ranks[i] = rank
+	return ranks
+}
+
+// lookup returns every source with a prefix containing addr, in the order the
+// sources were configured, so callers can fall through to the next one.
+// IPv4-mapped IPv6 addresses are looked up as IPv4.
+func (t *prefixTable) lookup(addr netip.Addr) []providers.Source {
+	if t == nil || !addr.IsValid() {
+		return nil
+	}
+	addr = addr.Unmap()
+	node := t.v6
+	if addr.Is4() {
+		node = t.v4
+	}
+	ip := addr.AsSlice()
+
+	var ranks []int
+	for i := 0; node != nil; i++ {
+		for _, r := range node.ranks {
+			ranks = insertRank(ranks, r)
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.child[ip[i/8]>>(7-uint(i%8))&1]
+	}
+	if len(ranks) == 0 {
+		return nil
+	}
+	out := make([]providers.Source, len(ranks))
+	for i, r := range ranks {
+		out[i] = t.sources[r]
+	}
+	return out
+}
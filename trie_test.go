@@ -0,0 +1,104 @@
+package traefik_warp
+
+import (
+	"math/rand"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+func Test_PrefixTable_Lookup(t *testing.T) {
+	sources := []providers.Source{
+		providers.Resolve(providers.Cloudflare)[0],
+		providers.Resolve(providers.Cloudfront)[0],
+	}
+	nets := map[providers.Provider][]netip.Prefix{}
+	for p, cidrs := range map[providers.Provider][]string{
+		providers.Cloudflare: {"198.51.100.0/24", "2001:db8::/32", "192.0.2.7/32"},
+		providers.Cloudfront: {"203.0.113.0/24", "198.51.0.0/16", "2001:db8:1::/48"},
+	} {
+		for _, c := range cidrs {
+			n, err := parseCIDROrIP(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nets[p] = append(nets[p], n)
+		}
+	}
+	table := buildTable(sources, nets)
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"198.51.100.1", "cloudflare,cloudfront"}, // also in cloudfront's /16: first source first
+		{"198.51.7.1", "cloudfront"},
+		{"203.0.113.255", "cloudfront"},
+		{"192.0.2.7", "cloudflare"},
+		{"192.0.2.8", ""},
+		{"::ffff:203.0.113.9", "cloudfront"},
+		{"2001:db8:1::1", "cloudflare,cloudfront"},
+		{"2001:db8:2::1", "cloudflare"},
+		{"2001:db9::1", ""},
+		{"10.0.0.1", ""},
+	}
+	for _, tc := range tests {
+		var names []string
+		for _, s := range table.lookup(netip.MustParseAddr(tc.ip)) {
+			names = append(names, string(s.Name()))
+		}
+		if got := strings.Join(names, ","); got != tc.want {
+			t.Fatalf("lookup(%s)=%q, want %q", tc.ip, got, tc.want)
+		}
+	}
+
+	// A source listing the same prefix as an earlier one is still returned.
+	nets[providers.Cloudfront] = append(nets[providers.Cloudfront], netip.MustParsePrefix("192.0.2.7/32"))
+	if got := buildTable(sources, nets).lookup(netip.MustParseAddr("192.0.2.7")); len(got) != 2 || got[1].Name() != providers.Cloudfront {
+		t.Fatalf("same prefix in two sources: got %d sources", len(got))
+	}
+
+	var empty *prefixTable
+	if empty.lookup(netip.MustParseAddr("198.51.100.1")) != nil {
+		t.Fatalf("nil table must not match")
+	}
+}
+
+func Test_PrefixTable_MatchesLinearScan(t *testing.T) {
+	sources := providers.Resolve(providers.Cloudflare)
+	nets := map[providers.Provider][]netip.Prefix{}
+	for _, c := range sources[0].(providers.Bundled).BundledIPS() {
+		n, err := parseCIDROrIP(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Addr().Is4() {
+			nets[providers.Cloudflare] = append(nets[providers.Cloudflare], n)
+		}
+	}
+	table := buildTable(sources, nets)
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		b := [4]byte{byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256))}
+		if i%2 == 0 {
+			// Bias towards addresses inside the list.
+			n := nets[providers.Cloudflare][rnd.Intn(len(nets[providers.Cloudflare]))]
+			b = n.Addr().As4()
+			b[3] = byte(rnd.Intn(256))
+		}
+		ip := netip.AddrFrom4(b)
+		want := false
+		for _, n := range nets[providers.Cloudflare] {
+			if n.Contains(ip) {
+				want = true
+				break
+			}
+		}
+		if got := len(table.lookup(ip)) > 0; got != want {
+			t.Fatalf("lookup(%s)=%v, linear scan=%v", ip, got, want)
+		}
+	}
+}
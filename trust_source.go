@@ -0,0 +1,81 @@
+package traefik_warp
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Trust sources, as configured in trustSource.from.
+const (
+	trustFromSocket        = "socket"        // req.RemoteAddr (default)
+	trustFromProxyProtocol = "proxyProtocol" // like socket, labelled as PROXY protocol; see resolve
+	trustFromHeader        = "header"        // a header set by a trusted L4 balancer
+)
+
+// Values of X-Warp-Trust-Source.
+const (
+	sourceSocket        = "socket"
+	sourceProxyProtocol = "proxy-protocol"
+	sourceHeader        = "header"
+	sourceForwardedFor  = "x-forwarded-for" // walked past intermediateProxies
+)
+
+// decisionSource resolves the address the trust decision is based on.
+type decisionSource struct {
+	from    string
+	header  string
+	proxies []netip.Prefix // balancer sockets allowed to set header
+}
+
+// newDecisionSource validates trustSource.
+func newDecisionSource(c TrustSource, allowAny bool) (*decisionSource, error) {
+	ds := &decisionSource{from: strings.TrimSpace(c.From), header: http.CanonicalHeaderKey(strings.TrimSpace(c.Header))}
+	switch strings.ToLower(ds.from) {
+	case "", strings.ToLower(trustFromSocket):
+		ds.from = trustFromSocket
+	case strings.ToLower(trustFromProxyProtocol):
+		ds.from = trustFromProxyProtocol
+	case strings.ToLower(trustFromHeader):
+		ds.from = trustFromHeader
+	default:
+		return nil, fmt.Errorf("invalid trustSource.from %q (want socket, proxyProtocol or header)", c.From)
+	}
+	if ds.from != trustFromHeader {
+		return ds, nil
+	}
+
+	if ds.header == "" || len(c.Proxies) == 0 {
+		return nil, fmt.Errorf("invalid trustSource config: from header requires header and proxies")
+	}
+	var err error
+	if ds.proxies, err = parsePrefixList("trustSource.proxies", c.Proxies, allowAny); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// resolve returns the address for the trust decision and its X-Warp-Trust-Source value.
+// In header mode the header is consumed, and only honored from a configured balancer.
+func (ds *decisionSource) resolve(req *http.Request) (string, string) {
+	if ds == nil {
+		return req.RemoteAddr, sourceSocket
+	}
+	switch ds.from {
+	case trustFromProxyProtocol:
+		// Traefik replaces RemoteAddr with the PROXY protocol source address when the
+		// entrypoint accepts PROXY protocol from proxyProtocol.trustedIPs. Middlewares
+		// cannot see whether it did, so this only labels the decision as configured.
+		return req.RemoteAddr, sourceProxyProtocol
+	case trustFromHeader:
+		v := req.Header.Get(ds.header)
+		req.Header.Del(ds.header)
+		if sock, ok := socketAddr(req.RemoteAddr); ok && containsAddr(ds.proxies, sock) {
+			if ip := extractClientIP(v); ip != "" {
+				return ip, sourceHeader
+			}
+		}
+	}
+	return req.RemoteAddr, sourceSocket
+}
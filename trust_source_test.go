@@ -0,0 +1,117 @@
+package traefik_warp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+type echoTrustSource struct{ captureNext }
+
+func (n echoTrustSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Got-Warp-Trust-Source", r.Header.Get("X-Warp-Trust-Source"))
+	w.Header().Set("Got-Edge-IP", r.Header.Get("X-Edge-IP"))
+	n.captureNext.ServeHTTP(w, r)
+}
+
+func Test_TrustSource_DecisionAddress(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         TrustSource
+		remoteAddr  string
+		edgeHeader  string
+		wantTrusted string
+		wantSource  string
+		wantIP      string
+	}{
+		{name: "socket default", remoteAddr: "198.51.100.10:443", wantTrusted: "yes", wantSource: "socket", wantIP: "4.4.4.4"},
+		{name: "socket untrusted", remoteAddr: "192.0.2.50:443", wantTrusted: "no", wantSource: "socket", wantIP: "192.0.2.50"},
+		{name: "proxy protocol", cfg: TrustSource{From: "proxyProtocol"}, remoteAddr: "198.51.100.10:443",
+			wantTrusted: "yes", wantSource: "proxy-protocol", wantIP: "4.4.4.4"},
+		{name: "header from balancer", cfg: TrustSource{From: "header", Header: "X-Edge-IP", Proxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.1.2.3:443", edgeHeader: "198.51.100.10", wantTrusted: "yes", wantSource: "header", wantIP: "4.4.4.4"},
+		{name: "header with port", cfg: TrustSource{From: "header", Header: "X-Edge-IP", Proxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.1.2.3:443", edgeHeader: "198.51.100.10:61000", wantTrusted: "yes", wantSource: "header", wantIP: "4.4.4.4"},
+		{name: "header from stranger ignored", cfg: TrustSource{From: "header", Header: "X-Edge-IP", Proxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "192.0.2.50:443", edgeHeader: "198.51.100.10", wantTrusted: "no", wantSource: "socket", wantIP: "192.0.2.50"},
+		{name: "header missing", cfg: TrustSource{From: "header", Header: "X-Edge-IP", Proxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.1.2.3:443", wantTrusted: "no", wantSource: "socket", wantIP: "10.1.2.3"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestDisolver(providers.Cloudflare)
+			d.next = echoTrustSource{}
+			d.TrustIP[providers.Cloudflare] = append(d.TrustIP[providers.Cloudflare], mustCIDR(t, "198.51.100.0/24"))
+			d.publish()
+			var err error
+			if d.decision, err = newDecisionSource(tc.cfg, false); err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://example.test/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set("CF-Connecting-IP", "4.4.4.4")
+			if tc.edgeHeader != "" {
+				req.Header.Set("X-Edge-IP", tc.edgeHeader)
+			}
+			d.ServeHTTP(rr, req)
+
+			if got := rr.Header().Get("Got-Warp-Trusted"); got != tc.wantTrusted {
+				t.Fatalf("X-Warp-Trusted=%q, want %q", got, tc.wantTrusted)
+			}
+			if got := rr.Header().Get("Got-Warp-Trust-Source"); got != tc.wantSource {
+				t.Fatalf("X-Warp-Trust-Source=%q, want %q", got, tc.wantSource)
+			}
+			if got := rr.Header().Get("Got-XRIP"); got != tc.wantIP {
+				t.Fatalf("X-Real-IP=%q, want %q", got, tc.wantIP)
+			}
+			if tc.cfg.From == "header" && rr.Header().Get("Got-Edge-IP") != "" {
+				t.Fatalf("balancer header must not reach the backend")
+			}
+		})
+	}
+}
+
+func Test_TrustSource_ForwardedForViaIntermediate(t *testing.T) {
+	d := newTestDisolver(providers.Cloudflare)
+	d.next = echoTrustSource{}
+	d.TrustIP[providers.Cloudflare] = append(d.TrustIP[providers.Cloudflare], mustCIDR(t, "198.51.100.0/24"))
+	d.publish()
+	var err error
+	if d.intermediates, err = parsePrefixList("intermediateProxies", []string{"10.0.0.0/8"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://example.test/", nil)
+	req.RemoteAddr = "10.1.2.3:443"
+	req.Header.Set("X-Forwarded-For", "4.4.4.4, 198.51.100.10")
+	req.Header.Set("CF-Connecting-IP", "4.4.4.4")
+	d.ServeHTTP(rr, req)
+
+	if got := rr.Header().Get("Got-Warp-Trust-Source"); got != "x-forwarded-for" {
+		t.Fatalf("X-Warp-Trust-Source=%q", got)
+	}
+}
+
+func Test_TrustSource_Config(t *testing.T) {
+	for _, bad := range []TrustSource{
+		{From: "tcp"},
+		{From: "header"},
+		{From: "header", Header: "X-Edge-IP"},
+		{From: "header", Header: "X-Edge-IP", Proxies: []string{"nope"}},
+		{From: "header", Header: "X-Edge-IP", Proxies: []string{"0.0.0.0/0"}},
+	} {
+		if _, err := newDecisionSource(bad, false); err == nil {
+			t.Fatalf("expected error for %+v", bad)
+		}
+	}
+	ds, err := newDecisionSource(TrustSource{From: "ProxyProtocol"}, false)
+	if err != nil || ds.from != trustFromProxyProtocol {
+		t.Fatalf("from should be case-insensitive: %+v, %v", ds, err)
+	}
+}
@@ -0,0 +1,72 @@
+package traefik_warp
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+	"github.com/l4rm4nd/traefik-warp/providers/cloudflare"
+)
+
+// cloudflareTunnel trusts requests relayed by local cloudflared connectors as
+// Cloudflare requests, so the usual Cloudflare header handling applies.
+type cloudflareTunnel struct {
+	connectors []netip.Prefix
+	ids        []string // accepted Cf-Warp-Tag-Id values; empty = not checked
+	source     providers.Source
+}
+
+// newCloudflareTunnel builds the tunnel mode from config, or returns nil when it is not configured.
+func newCloudflareTunnel(c CloudflareTunnel, sources []providers.Source, allowAny bool) (*cloudflareTunnel, error) {
+	if len(c.Connectors) == 0 {
+		if len(c.TunnelIDs) > 0 {
+			return nil, fmt.Errorf("invalid cloudflareTunnel config: tunnelIds require connectors")
+		}
+		return nil, nil
+	}
+
+	t := &cloudflareTunnel{}
+	for _, s := range sources {
+		if s.Name() == providers.Cloudflare {
+			t.source = s
+		}
+	}
+	if t.source == nil {
+		return nil, fmt.Errorf("invalid cloudflareTunnel config: provider must be cloudflare or auto")
+	}
+
+	var err error
+	if t.connectors, err = parsePrefixList("cloudflareTunnel.connectors", c.Connectors, allowAny); err != nil {
+		return nil, err
+	}
+	for _, id := range c.TunnelIDs {
+		if id = strings.TrimSpace(id); id != "" {
+			t.ids = append(t.ids, id)
+		}
+	}
+	return t, nil
+}
+
+// isConnector reports whether ip is a configured cloudflared connector.
+func (t *cloudflareTunnel) isConnector(ip netip.Addr) bool {
+	return t != nil && containsAddr(t.connectors, ip)
+}
+
+// verify checks the tunnel ID header when tunnel IDs are configured.
+func (t *cloudflareTunnel) verify(req *http.Request) bool {
+	if len(t.ids) == 0 {
+		return true
+	}
+	if req == nil {
+		return false
+	}
+	got := strings.TrimSpace(req.Header.Get(cloudflare.TunnelIDHeader))
+	for _, id := range t.ids {
+		if strings.EqualFold(got, id) {
+			return true
+		}
+	}
+	return false
+}
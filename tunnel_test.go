@@ -0,0 +1,89 @@
+package traefik_warp
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/l4rm4nd/traefik-warp/providers"
+)
+
+func Test_CloudflareTunnel_TrustsConnectors(t *testing.T) {
+	tests := []struct {
+		name         string
+		ids          []string
+		remoteAddr   string
+		tagID        string
+		wantTrusted  string
+		wantProvider string
+		wantIP       string
+		wantProto    string
+	}{
+		{name: "connector", remoteAddr: "172.18.0.5:40000", wantTrusted: "yes", wantProvider: "cloudflare", wantIP: "4.4.4.4", wantProto: "https"},
+		{name: "connector with tunnel id", ids: []string{"6f9c1c1e-0000-4000-8000-000000000001"}, remoteAddr: "172.18.0.5:40000",
+			tagID: "6F9C1C1E-0000-4000-8000-000000000001", wantTrusted: "yes", wantProvider: "cloudflare", wantIP: "4.4.4.4", wantProto: "https"},
+		{name: "wrong tunnel id", ids: []string{"6f9c1c1e-0000-4000-8000-000000000001"}, remoteAddr: "172.18.0.5:40000",
+			tagID: "other", wantTrusted: "no", wantProvider: "unknown", wantIP: "172.18.0.5", wantProto: "http"},
+		{name: "missing tunnel id", ids: []string{"6f9c1c1e-0000-4000-8000-000000000001"}, remoteAddr: "172.18.0.5:40000",
+			wantTrusted: "no", wantProvider: "unknown", wantIP: "172.18.0.5", wantProto: "http"},
+		{name: "not a connector", remoteAddr: "172.19.0.5:40000", wantTrusted: "no", wantProvider: "unknown", wantIP: "172.19.0.5", wantProto: "http"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestDisolver(providers.Auto)
+			tunnel, err := newCloudflareTunnel(CloudflareTunnel{Connectors: []string{"172.18.0.0/16"}, TunnelIDs: tc.ids}, d.sources, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.tunnel = tunnel
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://example.test/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set("CF-Connecting-IP", "4.4.4.4")
+			req.Header.Set("CF-Visitor", `{"scheme":"https"}`)
+			if tc.tagID != "" {
+				req.Header.Set("Cf-Warp-Tag-Id", tc.tagID)
+			}
+			d.ServeHTTP(rr, req)
+
+			if got := rr.Header().Get("Got-Warp-Trusted"); got != tc.wantTrusted {
+				t.Fatalf("X-Warp-Trusted=%q, want %q", got, tc.wantTrusted)
+			}
+			if got := rr.Header().Get("Got-Warp-Provider"); got != tc.wantProvider {
+				t.Fatalf("X-Warp-Provider=%q, want %q", got, tc.wantProvider)
+			}
+			if got := rr.Header().Get("Got-XRIP"); got != tc.wantIP {
+				t.Fatalf("X-Real-IP=%q, want %q", got, tc.wantIP)
+			}
+			if got := rr.Header().Get("Got-XFP"); got != tc.wantProto {
+				t.Fatalf("X-Forwarded-Proto=%q, want %q", got, tc.wantProto)
+			}
+		})
+	}
+}
+
+func Test_CloudflareTunnel_Config(t *testing.T) {
+	cf := providers.Resolve(providers.Cloudflare)
+	if tunnel, err := newCloudflareTunnel(CloudflareTunnel{}, cf, false); tunnel != nil || err != nil {
+		t.Fatalf("unconfigured tunnel: %v, %v", tunnel, err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     CloudflareTunnel
+		sources []providers.Source
+	}{
+		{name: "ids without connectors", cfg: CloudflareTunnel{TunnelIDs: []string{"x"}}, sources: cf},
+		{name: "bad connector", cfg: CloudflareTunnel{Connectors: []string{"172.18.0.0/33"}}, sources: cf},
+		{name: "catch-all connector", cfg: CloudflareTunnel{Connectors: []string{"::/0"}}, sources: cf},
+		{name: "other provider", cfg: CloudflareTunnel{Connectors: []string{"172.18.0.0/16"}}, sources: providers.Resolve(providers.Cloudfront)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newCloudflareTunnel(tc.cfg, tc.sources, false); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}